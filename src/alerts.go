@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// NotificationPreferences are the notification settings of an application.
+type NotificationPreferences struct {
+	Application   string `bson:"_id" json:"application"`
+	Email         bool   `bson:"email" json:"email"`
+	WebhookURL    string `bson:"webhookUrl" json:"webhookUrl"`
+	WebhookSecret string `bson:"webhookSecret" json:"webhookSecret"`
+	QuotaAlerts   bool   `bson:"quotaAlerts" json:"quotaAlerts"`
+	SpikeAlerts   bool   `bson:"spikeAlerts" json:"spikeAlerts"`
+}
+
+// DefaultNotificationPreferences returns the notification preferences used for applications that have not changed them.
+func DefaultNotificationPreferences(application string) *NotificationPreferences {
+	return &NotificationPreferences{
+		Application: application,
+		Email:       true,
+		QuotaAlerts: true,
+		SpikeAlerts: true,
+	}
+}
+
+// AlertEvaluator periodically checks every application and notifies owners when one of its tokens expires soon
+// and, if UsageAlerts is set, when their application passes a quota threshold or sees a spike in requests.
+type AlertEvaluator struct {
+	Store       Store
+	Notifier    Notifier
+	UsageAlerts bool
+}
+
+// Start runs the evaluator in the background at the configured interval.
+func (e *AlertEvaluator) Start() {
+	go func() {
+		ticker := time.NewTicker(config.Alerts.Interval)
+
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := e.Evaluate(time.Now()); err != nil {
+				log.Printf("Error: failed to evaluate usage alerts: %v\n", err)
+			}
+		}
+	}()
+}
+
+// Evaluate checks every application once, sending any notifications that are due at the given time.
+func (e *AlertEvaluator) Evaluate(now time.Time) error {
+	return e.Store.IterateApplications(func(application *Application) error {
+		if application.DeletedAt != nil {
+			return nil
+		}
+
+		if err := e.evaluateApplication(application, now); err != nil {
+			log.Printf("Error: failed to evaluate usage alerts for application %s: %v\n", application.ID, err)
+		}
+
+		return nil
+	})
+}
+
+func (e *AlertEvaluator) evaluateApplication(application *Application, now time.Time) error {
+	preferences, err := e.Store.GetNotificationPreferences(application.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if preferences == nil {
+		preferences = DefaultNotificationPreferences(application.ID)
+	}
+
+	if !preferences.Email && len(preferences.WebhookURL) < 1 {
+		return nil
+	}
+
+	notifications := make([]*Notification, 0)
+
+	if e.UsageAlerts && preferences.QuotaAlerts {
+		notification, err := e.checkQuota(application, now)
+
+		if err != nil {
+			return err
+		}
+
+		if notification != nil {
+			notifications = append(notifications, notification)
+		}
+	}
+
+	if e.UsageAlerts && preferences.SpikeAlerts {
+		notification, err := e.checkSpike(application, now)
+
+		if err != nil {
+			// Notifications that were already collected are not sent, so they are left for the next evaluation.
+			e.releaseAlerts(notifications...)
+
+			return err
+		}
+
+		if notification != nil {
+			notifications = append(notifications, notification)
+		}
+	}
+
+	expiring, err := e.checkTokenExpiry(application, now)
+
+	if err != nil {
+		e.releaseAlerts(notifications...)
+
+		return err
+	}
+
+	notifications = append(notifications, expiring...)
+
+	if len(notifications) < 1 {
+		return nil
+	}
+
+	owner, err := e.Store.GetUserByID(application.User)
+
+	if err != nil {
+		e.releaseAlerts(notifications...)
+
+		return err
+	}
+
+	var result error
+
+	for _, notification := range notifications {
+		if err := e.Notifier.Notify(notification, owner, preferences); err != nil {
+			// The notification is sent again on the next evaluation, as long as it is still due.
+			e.releaseAlerts(notification)
+
+			if result == nil {
+				result = err
+			}
+		}
+	}
+
+	return result
+}
+
+// releaseAlerts removes the alerts recorded for the notifications so that they can be sent again.
+func (e *AlertEvaluator) releaseAlerts(notifications ...*Notification) {
+	for _, notification := range notifications {
+		for _, id := range notification.alerts {
+			if err := e.Store.DeleteAlert(id); err != nil {
+				log.Printf("Error: failed to release alert %s: %v\n", id, err)
+			}
+		}
+	}
+}
+
+// checkQuota returns a notification for the highest quota threshold passed by the application that has not
+// been notified yet in the current period. Lower thresholds that were passed at the same time are marked as
+// notified without sending a notification for each.
+func (e *AlertEvaluator) checkQuota(application *Application, now time.Time) (*Notification, error) {
+	quota, err := GetApplicationQuota(e.Store, application)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if quota.Limit == nil || *quota.Limit < 1 {
+		return nil, nil
+	}
+
+	thresholds := append([]int{}, config.Alerts.Thresholds...)
+
+	sort.Ints(thresholds)
+
+	var (
+		percent   = float64(quota.Used) * 100 / float64(*quota.Limit)
+		threshold = 0
+		alerts    = make([]string, 0)
+	)
+
+	for _, value := range thresholds {
+		if percent < float64(value) {
+			break
+		}
+
+		key := fmt.Sprintf("%s:quota:%s:%d", application.ID, quota.PeriodStart.Format("2006-01"), value)
+
+		inserted, err := e.Store.InsertAlert(key, application.ID, quota.ResetsAt.AddDate(0, 0, 1))
+
+		if err != nil {
+			e.releaseAlerts(&Notification{alerts: alerts})
+
+			return nil, err
+		}
+
+		if inserted {
+			threshold = value
+			alerts = append(alerts, key)
+		}
+	}
+
+	if threshold < 1 {
+		return nil, nil
+	}
+
+	return &Notification{
+		Kind:        "quota.threshold",
+		Application: application.ID,
+		Subject:     fmt.Sprintf("%s has used %d%% of its monthly requests", application.Name, threshold),
+		Message:     fmt.Sprintf("Your application %s has made %d of its %d requests for this month. The allowance resets on %s.", application.Name, quota.Used, *quota.Limit, quota.ResetsAt.Format("January 2, 2006")),
+		Threshold:   threshold,
+		CreatedAt:   now.UTC(),
+		alerts:      alerts,
+		expiresAt:   quota.ResetsAt.AddDate(0, 0, 1),
+	}, nil
+}
+
+// checkSpike returns a notification if the requests in the last full hour exceed the trailing daily average
+// by the configured factor. Each hour is only notified once.
+func (e *AlertEvaluator) checkSpike(application *Application, now time.Time) (*Notification, error) {
+	if config.Alerts.SpikeFactor <= 0 {
+		return nil, nil
+	}
+
+	hourEnd := now.UTC().Truncate(time.Hour)
+	hourStart := hourEnd.Add(-time.Hour)
+
+	current, err := e.Store.SumRequestLogs(application.ID, hourStart, hourEnd)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if current < config.Alerts.SpikeMinimumRequests {
+		return nil, nil
+	}
+
+	trailing, err := e.Store.SumRequestLogs(application.ID, hourStart.Add(-time.Hour*24), hourStart)
+
+	if err != nil {
+		return nil, err
+	}
+
+	average := float64(trailing) / 24
+
+	if float64(current) <= average*config.Alerts.SpikeFactor {
+		return nil, nil
+	}
+
+	var (
+		key       = fmt.Sprintf("%s:spike:%s", application.ID, hourStart.Format(time.RFC3339))
+		expiresAt = hourEnd.Add(time.Hour * 24)
+	)
+
+	inserted, err := e.Store.InsertAlert(key, application.ID, expiresAt)
+
+	if err != nil || !inserted {
+		return nil, err
+	}
+
+	return &Notification{
+		Kind:        "usage.spike",
+		Application: application.ID,
+		Subject:     fmt.Sprintf("Unusual traffic for %s", application.Name),
+		Message:     fmt.Sprintf("Your application %s made %d requests between %s and %s UTC, compared to an average of %.0f requests per hour over the previous day.", application.Name, current, hourStart.Format("15:04"), hourEnd.Format("15:04"), average),
+		CreatedAt:   now.UTC(),
+		alerts:      []string{key},
+		expiresAt:   expiresAt,
+	}, nil
+}
+
+// checkTokenExpiry returns a notification for every token of the application that expires within the expiry
+// notice period. Each expiry time of a token is only notified once.
+func (e *AlertEvaluator) checkTokenExpiry(application *Application, now time.Time) ([]*Notification, error) {
+	if config.Tokens.ExpiryNoticePeriod <= 0 {
+		return nil, nil
+	}
+
+	tokens, err := e.Store.GetTokensByApplication(application.ID, &ListQuery{Sort: "name", Direction: "ascending"})
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Notification, 0)
+
+	for _, token := range tokens {
+		if token.ExpiresAt == nil || token.Disabled || token.IsExpired(now) || token.ExpiresAt.Sub(now) > config.Tokens.ExpiryNoticePeriod {
+			continue
+		}
+
+		key := fmt.Sprintf("%s:token-expiry:%s:%d", application.ID, token.ID, token.ExpiresAt.UnixMilli())
+
+		expiresAt := token.ExpiresAt.Add(time.Hour * 24)
+
+		inserted, err := e.Store.InsertAlert(key, application.ID, expiresAt)
+
+		if err != nil {
+			e.releaseAlerts(result...)
+
+			return nil, err
+		}
+
+		if !inserted {
+			continue
+		}
+
+		result = append(result, &Notification{
+			Kind:        "token.expiring",
+			Application: application.ID,
+			Token:       token.ID,
+			Subject:     fmt.Sprintf("A token of %s expires soon", application.Name),
+			Message:     fmt.Sprintf("The token %s of your application %s expires on %s UTC. Create a new token and update your clients before then to avoid any interruption.", token.Name, application.Name, token.ExpiresAt.UTC().Format("January 2, 2006 at 15:04")),
+			CreatedAt:   now.UTC(),
+			alerts:      []string{key},
+			expiresAt:   expiresAt,
+		})
+	}
+
+	return result, nil
+}
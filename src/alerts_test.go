@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingNotifier fails to send notifications of one kind and records the rest.
+type failingNotifier struct {
+	FakeNotifier
+	Kind string
+}
+
+func (n *failingNotifier) Notify(notification *Notification, owner *User, preferences *NotificationPreferences) error {
+	if notification.Kind == n.Kind {
+		return errors.New("failed to send notification")
+	}
+
+	return n.FakeNotifier.Notify(notification, owner, preferences)
+}
+
+func newTestAlertEvaluator(t *testing.T, notifier Notifier) (*AlertEvaluator, *Application) {
+	t.Helper()
+
+	store := NewMemoryStore()
+
+	if err := store.InsertUser(User{ID: "user", Email: "user@example.com", Type: "local", CreatedAt: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+
+	application := Application{
+		ID:        "application",
+		Name:      "Test Application",
+		User:      "user",
+		Plan:      "free",
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := store.InsertApplication(application); err != nil {
+		t.Fatal(err)
+	}
+
+	return &AlertEvaluator{Store: store, Notifier: notifier, UsageAlerts: true}, &application
+}
+
+func addUsage(t *testing.T, store Store, application string, timestamp time.Time, count int64) {
+	t.Helper()
+
+	if err := store.IncrementUsage(RandomHexString(8), []*UsageIncrement{{Application: application, Timestamp: timestamp, LastUsedAt: timestamp, RequestCount: count}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addSpike adds usage for the hour before now that is ten times the hourly average of the day before it.
+func addSpike(t *testing.T, store Store, application string, now time.Time) {
+	t.Helper()
+
+	hourStart := now.UTC().Truncate(time.Hour).Add(-time.Hour)
+
+	addUsage(t, store, application, hourStart.Add(-time.Hour*12), 24*config.Alerts.SpikeMinimumRequests/10)
+	addUsage(t, store, application, hourStart.Add(time.Minute*10), config.Alerts.SpikeMinimumRequests)
+}
+
+func notificationKinds(notifications []*Notification) []string {
+	result := make([]string, 0, len(notifications))
+
+	for _, notification := range notifications {
+		result = append(result, notification.Kind)
+	}
+
+	return result
+}
+
+func TestAlertEvaluatorQuotaThresholds(t *testing.T) {
+	notifier := &FakeNotifier{}
+	evaluator, application := newTestAlertEvaluator(t, notifier)
+
+	_, plan := application.GetPlan()
+
+	addUsage(t, evaluator.Store, application.ID, time.Now(), int64(plan.MonthlyRequests)*85/100)
+
+	if err := evaluator.Evaluate(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(notifier.Notifications) != 1 || notifier.Notifications[0].Threshold != 80 {
+		t.Fatalf("expected a single notification for the 80%% threshold, got %+v", notifier.Notifications)
+	}
+
+	addUsage(t, evaluator.Store, application.ID, time.Now(), int64(plan.MonthlyRequests)*20/100)
+
+	if err := evaluator.Evaluate(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(notifier.Notifications) != 2 || notifier.Notifications[1].Threshold != 100 {
+		t.Fatalf("expected a second notification for the 100%% threshold, got %+v", notifier.Notifications)
+	}
+}
+
+func TestAlertEvaluatorSpike(t *testing.T) {
+	notifier := &FakeNotifier{}
+	evaluator, application := newTestAlertEvaluator(t, notifier)
+	now := time.Now()
+
+	addUsage(t, evaluator.Store, application.ID, now.UTC().Truncate(time.Hour).Add(-time.Minute*30), config.Alerts.SpikeMinimumRequests-1)
+
+	if err := evaluator.Evaluate(now); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(notifier.Notifications) != 0 {
+		t.Fatalf("expected no notification below the minimum number of requests, got %+v", notifier.Notifications)
+	}
+
+	addSpike(t, evaluator.Store, application.ID, now)
+
+	if err := evaluator.Evaluate(now); err != nil {
+		t.Fatal(err)
+	}
+
+	if kinds := notificationKinds(notifier.Notifications); len(kinds) != 1 || kinds[0] != "usage.spike" {
+		t.Fatalf("expected a spike notification, got %v", kinds)
+	}
+}
+
+func TestAlertEvaluatorDeduplication(t *testing.T) {
+	notifier := &FakeNotifier{}
+	evaluator, application := newTestAlertEvaluator(t, notifier)
+	now := time.Now()
+
+	_, plan := application.GetPlan()
+
+	addUsage(t, evaluator.Store, application.ID, now, int64(plan.MonthlyRequests)/2)
+	addSpike(t, evaluator.Store, application.ID, now)
+
+	for i := 0; i < 3; i++ {
+		if err := evaluator.Evaluate(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if kinds := notificationKinds(notifier.Notifications); len(kinds) != 2 || kinds[0] != "quota.threshold" || kinds[1] != "usage.spike" {
+		t.Fatalf("expected each notification to be sent once, got %v", kinds)
+	}
+}
+
+func TestAlertEvaluatorFailedNotification(t *testing.T) {
+	notifier := &failingNotifier{Kind: "quota.threshold"}
+	evaluator, application := newTestAlertEvaluator(t, notifier)
+	now := time.Now()
+
+	_, plan := application.GetPlan()
+
+	addUsage(t, evaluator.Store, application.ID, now, int64(plan.MonthlyRequests)/2)
+	addSpike(t, evaluator.Store, application.ID, now)
+
+	if err := evaluator.evaluateApplication(application, now); err == nil {
+		t.Fatal("expected the failed notification to return an error")
+	}
+
+	if kinds := notificationKinds(notifier.Notifications); len(kinds) != 1 || kinds[0] != "usage.spike" {
+		t.Fatalf("expected the spike notification to be sent after the quota notification failed, got %v", kinds)
+	}
+
+	notifier.Kind = ""
+
+	if err := evaluator.evaluateApplication(application, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if kinds := notificationKinds(notifier.Notifications); len(kinds) != 2 || kinds[1] != "quota.threshold" {
+		t.Fatalf("expected the failed quota notification to be sent again, got %v", kinds)
+	}
+}
+
+func TestAlertEvaluatorTokenExpiry(t *testing.T) {
+	notifier := &FakeNotifier{}
+	evaluator, application := newTestAlertEvaluator(t, notifier)
+	now := time.Now()
+
+	// Token expiry notices do not depend on usage alerts being enabled.
+	evaluator.UsageAlerts = false
+
+	for _, expiresIn := range []time.Duration{time.Hour * 24 * 3, time.Hour * 24 * 30} {
+		expiresAt := now.Add(expiresIn).UTC()
+
+		if err := evaluator.Store.InsertToken(Token{ID: RandomHexString(8), Application: application.ID, Name: "Test Token", ExpiresAt: &expiresAt, CreatedAt: now.UTC()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := evaluator.Evaluate(now.Add(time.Minute * time.Duration(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if kinds := notificationKinds(notifier.Notifications); len(kinds) != 1 || kinds[0] != "token.expiring" {
+		t.Fatalf("expected a single notice for the token that expires within seven days, got %v", kinds)
+	}
+}
+
+func TestMultiNotifierRetriesFailedChannels(t *testing.T) {
+	evaluator, application := newTestAlertEvaluator(t, nil)
+	now := time.Now()
+
+	var (
+		email   = &FakeNotifier{}
+		webhook = &FakeNotifier{Err: errors.New("failed to send notification")}
+	)
+
+	evaluator.Notifier = &MultiNotifier{
+		Store:    evaluator.Store,
+		Channels: map[string]Notifier{"email": email, "webhook": webhook},
+	}
+
+	addSpike(t, evaluator.Store, application.ID, now)
+
+	for i := 0; i < 3; i++ {
+		if err := evaluator.evaluateApplication(application, now); err == nil {
+			t.Fatal("expected the failed webhook to return an error")
+		}
+	}
+
+	webhook.Err = nil
+
+	for i := 0; i < 2; i++ {
+		if err := evaluator.evaluateApplication(application, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(email.Notifications) != 1 || len(webhook.Notifications) != 1 {
+		t.Fatalf("expected each channel to deliver the notification once, got %d emails and %d webhooks", len(email.Notifications), len(webhook.Notifications))
+	}
+}
+
+func TestFakeNotifierError(t *testing.T) {
+	notifier := &FakeNotifier{Err: errors.New("failed to send notification")}
+	evaluator, application := newTestAlertEvaluator(t, notifier)
+
+	addSpike(t, evaluator.Store, application.ID, time.Now())
+
+	if err := evaluator.evaluateApplication(application, time.Now()); !errors.Is(err, notifier.Err) {
+		t.Fatalf("expected the notifier error, got %v", err)
+	}
+
+	if len(notifier.Notifications) != 0 {
+		t.Fatalf("expected no notifications to be recorded, got %+v", notifier.Notifications)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"os"
 	"strconv"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,6 +16,70 @@ var (
 		Host:        "127.0.0.1",
 		Port:        3002,
 		MongoDB:     "mongodb://127.0.0.1:27017/mcstatus",
+		Password: PasswordConfig{
+			Algorithm: "argon2id",
+			Argon2id: Argon2idConfig{
+				Memory:      64 * 1024,
+				Iterations:  3,
+				Parallelism: 2,
+			},
+			Bcrypt: BcryptConfig{
+				Cost: 12,
+			},
+		},
+		Sessions: SessionsConfig{
+			MaxAge:        time.Hour * 24 * 30,
+			IdleTimeout:   time.Hour * 24 * 7,
+			TouchInterval: time.Minute * 5,
+		},
+		Internal: InternalConfig{
+			Secret:           "",
+			CacheTTL:         time.Second * 30,
+			NegativeCacheTTL: time.Second * 10,
+			QuotaCacheTTL:    time.Minute,
+		},
+		DefaultPlan: "free",
+		Plans: map[string]PlanConfig{
+			"free": {
+				MonthlyRequests: 100_000,
+				BurstPerSecond:  10,
+			},
+			"pro": {
+				MonthlyRequests: 5_000_000,
+				BurstPerSecond:  100,
+			},
+		},
+		Alerts: AlertsConfig{
+			Enabled:              false,
+			Interval:             time.Minute * 5,
+			Thresholds:           []int{50, 80, 100},
+			SpikeFactor:          3,
+			SpikeMinimumRequests: 1000,
+			SMTP: SMTPConfig{
+				Port: 587,
+			},
+		},
+		Webhooks: WebhooksConfig{
+			PollInterval:   time.Second * 5,
+			Timeout:        time.Second * 10,
+			MaxAttempts:    8,
+			InitialBackoff: time.Second * 30,
+			MaxBackoff:     time.Hour * 6,
+			Concurrency:    8,
+		},
+		Retention: RetentionConfig{
+			GracePeriod:     time.Hour * 24 * 30,
+			PurgeInterval:   time.Hour,
+			PurgeRequestLog: false,
+		},
+		Tokens: TokensConfig{
+			RotationGracePeriod: time.Hour * 24,
+			ExpiryNoticePeriod:  time.Hour * 24 * 7,
+		},
+		Proxy: ProxyConfig{
+			Header:         "X-Forwarded-For",
+			TrustedProxies: []string{},
+		},
 	}
 )
 
@@ -24,6 +89,7 @@ type Config struct {
 	Host        string `yaml:"host"`
 	Port        uint16 `yaml:"port"`
 	MongoDB     string `yaml:"mongodb"`
+	Database    string `yaml:"database"`
 	Discord     struct {
 		ClientID    string `yaml:"client_id"`
 		Secret      string `yaml:"secret"`
@@ -34,6 +100,119 @@ type Config struct {
 		Secret      string `yaml:"secret"`
 		RedirectURI string `yaml:"redirect_uri"`
 	} `yaml:"github"`
+	Password    PasswordConfig        `yaml:"password"`
+	Sessions    SessionsConfig        `yaml:"sessions"`
+	Internal    InternalConfig        `yaml:"internal"`
+	DefaultPlan string                `yaml:"default_plan"`
+	Plans       map[string]PlanConfig `yaml:"plans"`
+	Alerts      AlertsConfig          `yaml:"alerts"`
+	Webhooks    WebhooksConfig        `yaml:"webhooks"`
+	Retention   RetentionConfig       `yaml:"retention"`
+	Tokens      TokensConfig          `yaml:"tokens"`
+	Proxy       ProxyConfig           `yaml:"proxy"`
+}
+
+// PasswordConfig represents the password hashing configuration.
+type PasswordConfig struct {
+	Algorithm string         `yaml:"algorithm"`
+	Argon2id  Argon2idConfig `yaml:"argon2id"`
+	Bcrypt    BcryptConfig   `yaml:"bcrypt"`
+}
+
+// Argon2idConfig represents the cost parameters used when hashing passwords with Argon2id.
+type Argon2idConfig struct {
+	Memory      uint32 `yaml:"memory"`
+	Iterations  uint32 `yaml:"iterations"`
+	Parallelism uint8  `yaml:"parallelism"`
+}
+
+// BcryptConfig represents the cost parameters used when hashing passwords with bcrypt.
+type BcryptConfig struct {
+	Cost int `yaml:"cost"`
+}
+
+// SessionsConfig represents the expiry settings of user sessions. A zero duration disables that limit.
+type SessionsConfig struct {
+	MaxAge        time.Duration `yaml:"max_age"`
+	IdleTimeout   time.Duration `yaml:"idle_timeout"`
+	TouchInterval time.Duration `yaml:"touch_interval"`
+}
+
+// InternalConfig represents the settings of the endpoints used by other mcstatus.io services.
+// The endpoints are disabled when the shared secret is empty.
+type InternalConfig struct {
+	Secret           string        `yaml:"secret"`
+	CacheTTL         time.Duration `yaml:"cache_ttl"`
+	NegativeCacheTTL time.Duration `yaml:"negative_cache_ttl"`
+	QuotaCacheTTL    time.Duration `yaml:"quota_cache_ttl"`
+}
+
+// PlanConfig represents the limits of a plan tier. A zero monthly request allowance or maximum token lifetime
+// means unlimited.
+type PlanConfig struct {
+	MonthlyRequests  uint64        `yaml:"monthly_requests"`
+	BurstPerSecond   uint32        `yaml:"burst_per_second"`
+	MaxTokenLifetime time.Duration `yaml:"max_token_lifetime"`
+}
+
+// AlertsConfig represents the settings of the usage alerts sent to application owners. Enabled only turns on the
+// quota and spike alerts, as token expiry notices are sent at the same interval and through the same channels
+// whenever the expiry notice period is set.
+type AlertsConfig struct {
+	Enabled              bool          `yaml:"enabled"`
+	Interval             time.Duration `yaml:"interval"`
+	Thresholds           []int         `yaml:"thresholds"`
+	SpikeFactor          float64       `yaml:"spike_factor"`
+	SpikeMinimumRequests int64         `yaml:"spike_minimum_requests"`
+	SMTP                 SMTPConfig    `yaml:"smtp"`
+}
+
+// SMTPConfig represents the mail server used to send email notifications.
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     uint16 `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+// WebhooksConfig represents the delivery settings of outgoing webhooks, which also apply to webhook
+// notifications. Webhooks cannot be delivered to private, loopback or link-local addresses unless
+// AllowPrivateNetworks is enabled, which should only be done in development.
+type WebhooksConfig struct {
+	PollInterval         time.Duration `yaml:"poll_interval"`
+	Timeout              time.Duration `yaml:"timeout"`
+	MaxAttempts          int           `yaml:"max_attempts"`
+	InitialBackoff       time.Duration `yaml:"initial_backoff"`
+	MaxBackoff           time.Duration `yaml:"max_backoff"`
+	Concurrency          int           `yaml:"concurrency"`
+	AllowPrivateNetworks bool          `yaml:"allow_private_networks"`
+}
+
+// RetentionConfig represents what happens to deleted applications and tokens. They can be restored during
+// the grace period, after which they are purged. Request logs are kept for reporting unless they are purged too.
+type RetentionConfig struct {
+	GracePeriod     time.Duration `yaml:"grace_period"`
+	PurgeInterval   time.Duration `yaml:"purge_interval"`
+	PurgeRequestLog bool          `yaml:"purge_request_log"`
+}
+
+// TokensConfig represents the settings of application tokens. The previous secret of a rotated token keeps
+// working for the rotation grace period, or stops working right away if it is zero. Owners are notified when
+// a token expires within the expiry notice period, which a zero duration disables.
+type TokensConfig struct {
+	RotationGracePeriod time.Duration `yaml:"rotation_grace_period"`
+	ExpiryNoticePeriod  time.Duration `yaml:"expiry_notice_period"`
+}
+
+// ProxyConfig represents the reverse proxies in front of the server. The IP address of a request, which the
+// allowed CIDR ranges of tokens are checked against, is read from the header if the request comes from one of
+// the trusted proxies, given as IP addresses or CIDR ranges. The proxies must replace the header rather than
+// append to it, since the first valid address in it is used. Without trusted proxies, the header is ignored
+// and the IP address of the connection is used.
+type ProxyConfig struct {
+	Header         string   `yaml:"header"`
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 // ReadFile reads the configuration from the given file and overrides values using environment variables.
@@ -62,6 +241,15 @@ func (c *Config) WriteFile(file string) error {
 	return os.WriteFile(file, data, 0777)
 }
 
+// DatabaseURI returns the URI of the database to connect to, preferring the database key over the mongodb key.
+func (c *Config) DatabaseURI() string {
+	if len(c.Database) > 0 {
+		return c.Database
+	}
+
+	return c.MongoDB
+}
+
 func (c *Config) overrideWithEnvVars() error {
 	if value := os.Getenv("ENVIRONMENT"); value != "" {
 		c.Environment = value
@@ -85,5 +273,13 @@ func (c *Config) overrideWithEnvVars() error {
 		c.MongoDB = value
 	}
 
+	if value := os.Getenv("DATABASE_URL"); value != "" {
+		c.Database = value
+	}
+
+	if value := os.Getenv("INTERNAL_SECRET"); value != "" {
+		c.Internal.Secret = value
+	}
+
 	return nil
 }
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// CascadeBatchSize is the number of documents removed at a time when deleting the documents that belong to
+	// another document without a transaction.
+	CascadeBatchSize int64 = 1000
+)
+
+// cascadeStep is the removal of every document matching the filter from a collection, as part of deleting
+// a document along with the documents that belong to it.
+type cascadeStep struct {
+	Collection string
+	Filter     bson.M
+}
+
+// Purger permanently deletes the applications and tokens whose grace period for being restored has passed.
+type Purger struct {
+	Store Store
+}
+
+// DeleteApplication soft deletes the application, which stops its tokens from working and hides it from lists
+// until it is either restored or purged.
+func DeleteApplication(store Store, application *Application) error {
+	tokens, err := store.GetTokensByApplication(application.ID, &ListQuery{Sort: "name", Direction: "ascending"})
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	if err := store.UpdateApplicationByID(application.ID, Fields{"deletedAt": now}); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		invalidateTokenCache(token)
+	}
+
+	application.DeletedAt = &now
+
+	EmitWebhookEvent(store, application.ID, "application.deleted", application)
+
+	return nil
+}
+
+// DeleteToken soft deletes the token, which stops it from working and hides it from lists until it is either
+// restored or purged.
+func DeleteToken(store Store, token *Token) error {
+	now := time.Now().UTC()
+
+	if err := store.UpdateTokenByID(token.ID, Fields{"deletedAt": now}); err != nil {
+		return err
+	}
+
+	invalidateTokenCache(token)
+
+	token.DeletedAt = &now
+
+	EmitWebhookEvent(store, token.Application, "token.deleted", token)
+
+	return nil
+}
+
+// DeleteUser permanently deletes the user and their sessions. Their applications are soft deleted and purged
+// once the grace period has passed, since nobody is left who could restore them.
+func DeleteUser(store Store, user *User) error {
+	applications, err := store.GetApplicationsByUser(user.ID, &ListQuery{Sort: "name", Direction: "ascending"})
+
+	if err != nil {
+		return err
+	}
+
+	tokens := make([]*Token, 0)
+
+	for _, application := range applications {
+		values, err := store.GetTokensByApplication(application.ID, &ListQuery{Sort: "name", Direction: "ascending"})
+
+		if err != nil {
+			return err
+		}
+
+		tokens = append(tokens, values...)
+	}
+
+	now := time.Now().UTC()
+
+	if err := store.DeleteUser(user.ID, now); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		invalidateTokenCache(token)
+	}
+
+	for _, application := range applications {
+		application.DeletedAt = &now
+
+		EmitWebhookEvent(store, application.ID, "application.deleted", application)
+	}
+
+	return nil
+}
+
+// RestoreApplication undoes the soft deletion of the application.
+func RestoreApplication(store Store, application *Application) error {
+	if err := store.UpdateApplicationByID(application.ID, Fields{"deletedAt": nil}); err != nil {
+		return err
+	}
+
+	tokens, err := store.GetTokensByApplication(application.ID, &ListQuery{Sort: "name", Direction: "ascending"})
+
+	if err != nil {
+		return err
+	}
+
+	// The tokens may have been cached as inactive while the application was deleted.
+	for _, token := range tokens {
+		invalidateTokenCache(token)
+	}
+
+	application.DeletedAt = nil
+
+	EmitWebhookEvent(store, application.ID, "application.restored", application)
+
+	return nil
+}
+
+// RestoreToken undoes the soft deletion of the token.
+func RestoreToken(store Store, token *Token) error {
+	if err := store.UpdateTokenByID(token.ID, Fields{"deletedAt": nil}); err != nil {
+		return err
+	}
+
+	invalidateTokenCache(token)
+
+	token.DeletedAt = nil
+
+	EmitWebhookEvent(store, token.Application, "token.restored", token)
+
+	return nil
+}
+
+// IsRestorable returns whether a resource deleted at the time is still within the grace period.
+func IsRestorable(deletedAt *time.Time) bool {
+	return deletedAt != nil && time.Since(*deletedAt) < config.Retention.GracePeriod
+}
+
+// Start runs the purger in the background, once right away and then at the configured interval.
+func (p *Purger) Start() {
+	go func() {
+		ticker := time.NewTicker(config.Retention.PurgeInterval)
+
+		defer ticker.Stop()
+
+		for {
+			if err := p.Purge(); err != nil {
+				log.Printf("Error: failed to purge deleted resources: %v\n", err)
+			}
+
+			<-ticker.C
+		}
+	}()
+}
+
+// Purge permanently deletes every application and token that was deleted before the grace period.
+func (p *Purger) Purge() error {
+	before := time.Now().Add(-config.Retention.GracePeriod)
+
+	applications, err := p.Store.GetDeletedApplications(before)
+
+	if err != nil {
+		return err
+	}
+
+	for _, application := range applications {
+		if err := p.Store.DeleteApplication(application.ID, config.Retention.PurgeRequestLog); err != nil {
+			return err
+		}
+	}
+
+	tokens, err := p.Store.GetDeletedTokens(before)
+
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		if err := p.Store.DeleteTokenByID(token.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applicationCascade returns the steps that delete the application and the documents that belong to it.
+func applicationCascade(id string, purgeRequestLog bool) []cascadeStep {
+	steps := []cascadeStep{
+		{Collection: CollectionTokens, Filter: bson.M{"application": id}},
+		{Collection: CollectionDeliveries, Filter: bson.M{"application": id}},
+		{Collection: CollectionWebhooks, Filter: bson.M{"application": id}},
+		{Collection: CollectionPreferences, Filter: bson.M{"_id": id}},
+		{Collection: CollectionAlerts, Filter: bson.M{"application": id}},
+	}
+
+	if purgeRequestLog {
+		steps = append(steps, cascadeStep{Collection: CollectionRequestLog, Filter: bson.M{"application": id}})
+	}
+
+	return append(steps, cascadeStep{Collection: CollectionApplications, Filter: bson.M{"_id": id}})
+}
+
+// deleteCascade runs the steps inside a transaction if the deployment supports them. Otherwise, each step
+// removes its documents in batches of CascadeBatchSize. The document being deleted is removed by the last step,
+// so a failed deletion leaves it in place to be deleted again, such as by the next purge, which only has to
+// remove the documents that are left.
+func (c *MongoDB) deleteCascade(steps []cascadeStep) error {
+	if !c.Transactions {
+		for _, step := range steps {
+			if err := c.removeDocuments(step); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	defer cancel()
+
+	session, err := c.Client.StartSession()
+
+	if err != nil {
+		return err
+	}
+
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		for _, step := range steps {
+			if _, err := c.Database.Collection(step.Collection).DeleteMany(sc, step.Filter); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	})
+
+	return err
+}
+
+// removeDocuments removes the documents matching the filter of the step one batch at a time, so that only the
+// IDs of a single batch are kept in memory however many documents match.
+func (c *MongoDB) removeDocuments(step cascadeStep) error {
+	for {
+		removed, err := c.removeDocumentBatch(step)
+
+		if err != nil {
+			return err
+		}
+
+		if removed < CascadeBatchSize {
+			return nil
+		}
+	}
+}
+
+func (c *MongoDB) removeDocumentBatch(step cascadeStep) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+
+	defer cancel()
+
+	cur, err := c.Database.Collection(step.Collection).Find(ctx, step.Filter, options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(CascadeBatchSize))
+
+	if err != nil {
+		return 0, err
+	}
+
+	var documents []bson.Raw
+
+	if err := cur.All(ctx, &documents); err != nil {
+		return 0, err
+	}
+
+	if len(documents) < 1 {
+		return 0, nil
+	}
+
+	ids := make(bson.A, 0, len(documents))
+
+	for _, document := range documents {
+		ids = append(ids, document.Lookup("_id"))
+	}
+
+	if _, err := c.Database.Collection(step.Collection).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return 0, err
+	}
+
+	return int64(len(documents)), nil
+}
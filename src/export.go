@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+var (
+	// UsageExportFormats maps each supported usage export format to its content type.
+	UsageExportFormats map[string]string = map[string]string{
+		"csv":    "text/csv",
+		"ndjson": "application/x-ndjson",
+	}
+)
+
+// UsageExport describes a usage export requested by the user.
+type UsageExport struct {
+	Query  *UsageQuery
+	Format string
+	Group  string
+}
+
+// ParseUsageExport parses the from, to, format, group, interval and tz query parameters of a usage export
+// request. The format falls back to the Accept header when not provided. The returned error describes the
+// invalid parameter and is safe to return to the user.
+func ParseUsageExport(ctx *fiber.Ctx) (*UsageExport, error) {
+	var (
+		err    error
+		now    = time.Now()
+		export = &UsageExport{
+			Query: &UsageQuery{
+				Interval: utils.CopyString(ctx.Query("interval", "day")),
+				Location: time.UTC,
+			},
+			Format: utils.CopyString(ctx.Query("format")),
+			Group:  utils.CopyString(ctx.Query("group")),
+		}
+	)
+
+	if len(export.Format) < 1 {
+		switch ctx.Accepts("text/csv", "application/x-ndjson", "application/ndjson") {
+		case "application/x-ndjson", "application/ndjson":
+			export.Format = "ndjson"
+		default:
+			export.Format = "csv"
+		}
+	}
+
+	if _, ok := UsageExportFormats[export.Format]; !ok {
+		return nil, fmt.Errorf("invalid format: %s", export.Format)
+	}
+
+	switch export.Group {
+	case "", "token":
+		break
+	case "interval":
+		if _, ok := UsageIntervalMaxRanges[export.Query.Interval]; !ok {
+			return nil, fmt.Errorf("invalid interval: %s", export.Query.Interval)
+		}
+
+		timezone := ctx.Query("tz", "UTC")
+
+		if timezone == "Local" {
+			return nil, fmt.Errorf("invalid timezone: %s", timezone)
+		}
+
+		if export.Query.Location, err = time.LoadLocation(timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %s", timezone)
+		}
+	default:
+		return nil, fmt.Errorf("invalid group: %s", export.Group)
+	}
+
+	if export.Query.From, err = parseUsageTime(ctx.Query("from"), now.AddDate(0, 0, -30)); err != nil {
+		return nil, errors.New("invalid from value, expected a Unix timestamp in milliseconds")
+	}
+
+	if export.Query.To, err = parseUsageTime(ctx.Query("to"), now); err != nil {
+		return nil, errors.New("invalid to value, expected a Unix timestamp in milliseconds")
+	}
+
+	if !export.Query.From.Before(export.Query.To) {
+		return nil, errors.New("from must be before to")
+	}
+
+	return export, nil
+}
+
+// WriteUsageExport streams the rows of the export to the writer, flushing periodically so that the
+// export is never held in memory in its entirety.
+func WriteUsageExport(store Store, w *bufio.Writer, export *UsageExport) error {
+	var (
+		columns   []string
+		rowCount  = 0
+		csvWriter = csv.NewWriter(w)
+		encoder   = json.NewEncoder(w)
+	)
+
+	switch export.Group {
+	case "token":
+		columns = []string{"token", "requestCount"}
+	case "interval":
+		columns = []string{"timestamp", "requestCount"}
+	default:
+		columns = []string{"timestamp", "token", "requestCount"}
+	}
+
+	if export.Format == "csv" {
+		if err := csvWriter.Write(columns); err != nil {
+			return err
+		}
+	}
+
+	err := store.IterateRequestLogExport(export.Query, export.Group, func(row *RequestLogBucket) error {
+		values := map[string]string{
+			"timestamp":    row.Timestamp.In(export.Query.Location).Format(time.RFC3339),
+			"token":        row.Token,
+			"requestCount": strconv.FormatInt(row.RequestCount, 10),
+		}
+
+		if export.Format == "csv" {
+			record := make([]string, 0, len(columns))
+
+			for _, column := range columns {
+				record = append(record, values[column])
+			}
+
+			if err := csvWriter.Write(record); err != nil {
+				return err
+			}
+
+			csvWriter.Flush()
+		} else {
+			object := make(map[string]interface{}, len(columns))
+
+			for _, column := range columns {
+				object[column] = values[column]
+			}
+
+			object["requestCount"] = row.RequestCount
+
+			if err := encoder.Encode(object); err != nil {
+				return err
+			}
+		}
+
+		if rowCount++; rowCount%1000 == 0 {
+			return w.Flush()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	csvWriter.Flush()
+
+	if err := csvWriter.Error(); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
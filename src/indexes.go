@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// MongoDBIndexes are the indexes that the queries of the MongoDB store rely on. They are reconciled with
+	// the indexes that exist in the database every time the server starts.
+	MongoDBIndexes []MongoDBIndex = []MongoDBIndex{
+		{Collection: CollectionUsers, Keys: bson.D{{Key: "email", Value: 1}}, Unique: true},
+		{Collection: CollectionSessions, Keys: bson.D{{Key: "user", Value: 1}}},
+		{Collection: CollectionSessions, Keys: bson.D{{Key: "expiresAt", Value: 1}}, ExpireAfter: expireAfter(0)},
+		{Collection: CollectionApplications, Keys: bson.D{{Key: "user", Value: 1}}},
+		{Collection: CollectionApplications, Keys: bson.D{{Key: "deletedAt", Value: 1}}},
+		{Collection: CollectionTokens, Keys: bson.D{{Key: "application", Value: 1}}},
+		{Collection: CollectionTokens, Keys: bson.D{{Key: "deletedAt", Value: 1}}},
+		{Collection: CollectionTokens, Keys: bson.D{{Key: "hash", Value: 1}}, Unique: true, PartialFilterExpression: bson.D{{Key: "hash", Value: bson.D{{Key: "$type", Value: "string"}}}}},
+		{Collection: CollectionTokens, Keys: bson.D{{Key: "previousSecretHash", Value: 1}}},
+		{Collection: CollectionRequestLog, Keys: bson.D{{Key: "application", Value: 1}, {Key: "timestamp", Value: 1}}},
+		{Collection: CollectionRequestLog, Keys: bson.D{{Key: "application", Value: 1}, {Key: "token", Value: 1}, {Key: "timestamp", Value: 1}}, Unique: true},
+		{Collection: CollectionUsageBatches, Keys: bson.D{{Key: "createdAt", Value: 1}}, ExpireAfter: expireAfter(time.Hour * 24 * 7)},
+		{Collection: CollectionAlerts, Keys: bson.D{{Key: "expiresAt", Value: 1}}, ExpireAfter: expireAfter(0)},
+		{Collection: CollectionWebhooks, Keys: bson.D{{Key: "application", Value: 1}}},
+		{Collection: CollectionDeliveries, Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Collection: CollectionDeliveries, Keys: bson.D{{Key: "webhook", Value: 1}, {Key: "createdAt", Value: -1}}},
+	}
+)
+
+// MongoDBIndex is the definition of an index on a MongoDB collection. If PartialFilterExpression is set,
+// only the documents matching it are indexed.
+type MongoDBIndex struct {
+	Collection              string
+	Keys                    bson.D
+	Unique                  bool
+	ExpireAfter             *int64
+	PartialFilterExpression bson.D
+}
+
+// IndexDrift is a difference between the index definitions and the indexes that exist in the database.
+type IndexDrift struct {
+	Collection string
+	Name       string
+	Kind       string
+	index      MongoDBIndex
+	existing   existingIndex
+}
+
+type existingIndex struct {
+	Name                    string `bson:"name"`
+	Key                     bson.D `bson:"key"`
+	Unique                  bool   `bson:"unique"`
+	ExpireAfterSeconds      *int64 `bson:"expireAfterSeconds"`
+	PartialFilterExpression bson.D `bson:"partialFilterExpression"`
+}
+
+// Name returns the name of the index, which is the same as the name MongoDB generates for it by default.
+func (i MongoDBIndex) Name() string {
+	parts := make([]string, 0, len(i.Keys)*2)
+
+	for _, key := range i.Keys {
+		parts = append(parts, key.Key, fmt.Sprint(key.Value))
+	}
+
+	return strings.Join(parts, "_")
+}
+
+// alternateName returns the name that the index is rebuilt under when it has changed, so that the index it
+// replaces is kept until the rebuilt index has been created. An index with either name is the same index.
+func (i MongoDBIndex) alternateName() string {
+	return i.Name() + "_rebuilt"
+}
+
+func (i MongoDBIndex) model(name string) mongo.IndexModel {
+	opts := options.Index().SetName(name)
+
+	if i.Unique {
+		opts.SetUnique(true)
+	}
+
+	if i.ExpireAfter != nil {
+		opts.SetExpireAfterSeconds(int32(*i.ExpireAfter))
+	}
+
+	if len(i.PartialFilterExpression) > 0 {
+		opts.SetPartialFilterExpression(i.PartialFilterExpression)
+	}
+
+	return mongo.IndexModel{Keys: i.Keys, Options: opts}
+}
+
+// model returns the model that creates the index again as it exists.
+func (i existingIndex) model() mongo.IndexModel {
+	opts := options.Index().SetName(i.Name)
+
+	if i.Unique {
+		opts.SetUnique(true)
+	}
+
+	if i.ExpireAfterSeconds != nil {
+		opts.SetExpireAfterSeconds(int32(*i.ExpireAfterSeconds))
+	}
+
+	if len(i.PartialFilterExpression) > 0 {
+		opts.SetPartialFilterExpression(i.PartialFilterExpression)
+	}
+
+	return mongo.IndexModel{Keys: i.Key, Options: opts}
+}
+
+func (i MongoDBIndex) matches(index existingIndex) bool {
+	if i.Unique != index.Unique || len(i.Keys) != len(index.Key) {
+		return false
+	}
+
+	if (i.ExpireAfter == nil) != (index.ExpireAfterSeconds == nil) || (i.ExpireAfter != nil && *i.ExpireAfter != *index.ExpireAfterSeconds) {
+		return false
+	}
+
+	if !sameDocument(i.PartialFilterExpression, index.PartialFilterExpression) {
+		return false
+	}
+
+	for k, key := range i.Keys {
+		if key.Key != index.Key[k].Key || fmt.Sprint(key.Value) != fmt.Sprint(index.Key[k].Value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String describes the difference as it is logged.
+func (d IndexDrift) String() string {
+	if d.Kind == "extra" {
+		return fmt.Sprintf("Index %s.%s is not defined by the server", d.Collection, d.Name)
+	}
+
+	return fmt.Sprintf("Index %s.%s is %s", d.Collection, d.Name, d.Kind)
+}
+
+// ReconcileIndexes compares the index definitions with the indexes in the database and logs every difference.
+// If apply is true, missing indexes are created and changed indexes are rebuilt. Extra indexes are never
+// dropped, since they may have been created by hand.
+func (c *MongoDB) ReconcileIndexes(apply bool) ([]IndexDrift, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*5)
+
+	defer cancel()
+
+	existing := make(map[string]map[string]existingIndex)
+
+	for _, index := range MongoDBIndexes {
+		if _, ok := existing[index.Collection]; ok {
+			continue
+		}
+
+		indexes, err := c.listIndexes(ctx, index.Collection)
+
+		if err != nil {
+			return nil, err
+		}
+
+		existing[index.Collection] = indexes
+	}
+
+	result := planIndexes(MongoDBIndexes, existing)
+
+	for _, drift := range result {
+		log.Println(drift)
+	}
+
+	if !apply {
+		return result, nil
+	}
+
+	for _, drift := range result {
+		var err error
+
+		switch drift.Kind {
+		case "missing":
+			err = c.createIndex(ctx, drift.index, drift.index.Name())
+		case "changed":
+			err = c.rebuildIndex(ctx, drift)
+		}
+
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// planIndexes compares the index definitions with the existing indexes of each collection. The differences are
+// returned in the order of the definitions, followed by the extra indexes of each collection sorted by name.
+func planIndexes(definitions []MongoDBIndex, existing map[string]map[string]existingIndex) []IndexDrift {
+	var (
+		result      = make([]IndexDrift, 0)
+		collections = make([]string, 0)
+		declared    = make(map[string]map[string]bool)
+	)
+
+	for _, index := range definitions {
+		if _, ok := declared[index.Collection]; !ok {
+			collections = append(collections, index.Collection)
+			declared[index.Collection] = make(map[string]bool)
+		}
+
+		current, ok := existing[index.Collection][index.Name()]
+
+		// After an index has been rebuilt, it has the alternate name. If both exist, because the old index could
+		// not be dropped after the rebuild, the one that matches the definition is used and the other is extra.
+		if alternate, found := existing[index.Collection][index.alternateName()]; found && (!ok || (!index.matches(current) && index.matches(alternate))) {
+			current, ok = alternate, true
+		}
+
+		switch {
+		case !ok:
+			result = append(result, IndexDrift{Collection: index.Collection, Name: index.Name(), Kind: "missing", index: index})
+		case !index.matches(current):
+			result = append(result, IndexDrift{Collection: index.Collection, Name: current.Name, Kind: "changed", index: index, existing: current})
+		}
+
+		if ok {
+			declared[index.Collection][current.Name] = true
+		}
+	}
+
+	for _, collection := range collections {
+		names := make([]string, 0)
+
+		for name := range existing[collection] {
+			if name != "_id_" && !declared[collection][name] {
+				names = append(names, name)
+			}
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			result = append(result, IndexDrift{Collection: collection, Name: name, Kind: "extra"})
+		}
+	}
+
+	return result
+}
+
+// rebuildIndex replaces a changed index. The new index is built under the other name of the index first, so
+// the old index is only dropped once the new one exists. MongoDB does not allow two indexes with the same keys
+// and most other differences, in which case the old index is dropped first, after checking that a unique index
+// can be created, and created again if the new index cannot be.
+func (c *MongoDB) rebuildIndex(ctx context.Context, drift IndexDrift) error {
+	var (
+		index = drift.index
+		name  = index.Name()
+	)
+
+	if drift.existing.Name == name {
+		name = index.alternateName()
+	}
+
+	_, err := c.Database.Collection(index.Collection).Indexes().CreateOne(ctx, index.model(name))
+
+	if err == nil {
+		log.Printf("Created index %s.%s\n", index.Collection, name)
+
+		return c.dropIndex(ctx, index.Collection, drift.existing.Name)
+	}
+
+	if index.Unique && mongo.IsDuplicateKeyError(err) {
+		return c.reportDuplicates(ctx, index, err)
+	}
+
+	var commandError mongo.CommandError
+
+	// IndexOptionsConflict and IndexKeySpecsConflict are returned when the index cannot exist next to the old one.
+	if !errors.As(err, &commandError) || (commandError.Code != 85 && commandError.Code != 86) {
+		return fmt.Errorf("failed to create index %s.%s: %w", index.Collection, name, err)
+	}
+
+	if index.Unique {
+		if err := c.reportDuplicates(ctx, index, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := c.dropIndex(ctx, index.Collection, drift.existing.Name); err != nil {
+		return err
+	}
+
+	if err := c.createIndex(ctx, index, name); err != nil {
+		if _, restoreErr := c.Database.Collection(index.Collection).Indexes().CreateOne(ctx, drift.existing.model()); restoreErr != nil {
+			log.Printf("Error: failed to restore index %s.%s: %v\n", index.Collection, drift.existing.Name, restoreErr)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (c *MongoDB) createIndex(ctx context.Context, index MongoDBIndex, name string) error {
+	if _, err := c.Database.Collection(index.Collection).Indexes().CreateOne(ctx, index.model(name)); err != nil {
+		if index.Unique && mongo.IsDuplicateKeyError(err) {
+			return c.reportDuplicates(ctx, index, err)
+		}
+
+		return fmt.Errorf("failed to create index %s.%s: %w", index.Collection, name, err)
+	}
+
+	log.Printf("Created index %s.%s\n", index.Collection, name)
+
+	return nil
+}
+
+func (c *MongoDB) dropIndex(ctx context.Context, collection, name string) error {
+	if _, err := c.Database.Collection(collection).Indexes().DropOne(ctx, name); err != nil {
+		return fmt.Errorf("failed to drop index %s.%s: %w", collection, name, err)
+	}
+
+	log.Printf("Dropped index %s.%s\n", collection, name)
+
+	return nil
+}
+
+// reportDuplicates logs the values that prevent the unique index from being created, and returns an error
+// explaining that they must be resolved by hand. If there are no duplicates, the cause is returned instead,
+// which is nil when checking whether the index can be created before changing anything.
+func (c *MongoDB) reportDuplicates(ctx context.Context, index MongoDBIndex, cause error) error {
+	group := bson.D{}
+
+	for _, key := range index.Keys {
+		group = append(group, bson.E{Key: key.Key, Value: "$" + key.Key})
+	}
+
+	pipeline := mongo.Pipeline{}
+
+	if len(index.PartialFilterExpression) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: index.PartialFilterExpression}})
+	}
+
+	pipeline = append(
+		pipeline,
+		bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: group}, {Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}, {Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}}}}},
+		bson.D{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+		bson.D{{Key: "$limit", Value: 100}},
+	)
+
+	cur, err := c.Database.Collection(index.Collection).Aggregate(ctx, pipeline)
+
+	if err != nil {
+		return fmt.Errorf("failed to find the duplicate values of unique index %s.%s: %w", index.Collection, index.Name(), err)
+	}
+
+	defer cur.Close(ctx)
+
+	found := false
+
+	for cur.Next(ctx) {
+		found = true
+
+		var duplicate struct {
+			Value bson.D        `bson:"_id"`
+			Count int64         `bson:"count"`
+			IDs   []interface{} `bson:"ids"`
+		}
+
+		if err := cur.Decode(&duplicate); err != nil {
+			return err
+		}
+
+		log.Printf("Duplicate value %v in %s is shared by %d documents: %v\n", duplicate.Value, index.Collection, duplicate.Count, duplicate.IDs)
+	}
+
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	if !found {
+		return cause
+	}
+
+	return fmt.Errorf("cannot create unique index %s.%s because some documents share the same value, change or remove the duplicates logged above and restart the server", index.Collection, index.Name())
+}
+
+func (c *MongoDB) listIndexes(ctx context.Context, collection string) (map[string]existingIndex, error) {
+	result := make(map[string]existingIndex)
+
+	cur, err := c.Database.Collection(collection).Indexes().List(ctx)
+
+	var commandError mongo.CommandError
+
+	// Listing the indexes of a collection that does not exist yet fails with NamespaceNotFound.
+	if errors.As(err, &commandError) && commandError.Code == 26 {
+		return result, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var index existingIndex
+
+		if err := cur.Decode(&index); err != nil {
+			return nil, err
+		}
+
+		result[index.Name] = index
+	}
+
+	return result, cur.Err()
+}
+
+// CheckMongoDBIndexes connects to the MongoDB database at the URI and reports the differences between the
+// index definitions and the existing indexes without changing them.
+func CheckMongoDBIndexes(uri string) ([]IndexDrift, error) {
+	if GetStoreName(uri) != "mongodb" {
+		return nil, fmt.Errorf("indexes can only be checked on MongoDB databases")
+	}
+
+	db := &MongoDB{}
+
+	if err := db.Connect(uri); err != nil {
+		return nil, err
+	}
+
+	defer db.Close()
+
+	return db.ReconcileIndexes(false)
+}
+
+// sameDocument returns whether the documents have the same fields and values in the same order.
+func sameDocument(a, b bson.D) bool {
+	if len(a) < 1 || len(b) < 1 {
+		return len(a) == len(b)
+	}
+
+	first, err := bson.Marshal(a)
+
+	if err != nil {
+		return false
+	}
+
+	second, err := bson.Marshal(b)
+
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(first, second)
+}
+
+func expireAfter(duration time.Duration) *int64 {
+	result := int64(duration.Seconds())
+
+	return &result
+}
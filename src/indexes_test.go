@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMongoDBIndexMatches(t *testing.T) {
+	index := MongoDBIndex{
+		Collection:              CollectionTokens,
+		Keys:                    bson.D{{Key: "hash", Value: 1}},
+		Unique:                  true,
+		PartialFilterExpression: bson.D{{Key: "hash", Value: bson.D{{Key: "$type", Value: "string"}}}},
+	}
+
+	tests := []struct {
+		name     string
+		existing existingIndex
+		matches  bool
+	}{
+		{"same", existingIndex{Key: bson.D{{Key: "hash", Value: int32(1)}}, Unique: true, PartialFilterExpression: bson.D{{Key: "hash", Value: bson.D{{Key: "$type", Value: "string"}}}}}, true},
+		{"missing partial filter", existingIndex{Key: bson.D{{Key: "hash", Value: int32(1)}}, Unique: true}, false},
+		{"different partial filter", existingIndex{Key: bson.D{{Key: "hash", Value: int32(1)}}, Unique: true, PartialFilterExpression: bson.D{{Key: "hash", Value: bson.D{{Key: "$exists", Value: true}}}}}, false},
+		{"not unique", existingIndex{Key: bson.D{{Key: "hash", Value: int32(1)}}, PartialFilterExpression: bson.D{{Key: "hash", Value: bson.D{{Key: "$type", Value: "string"}}}}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if matches := index.matches(test.existing); matches != test.matches {
+				t.Fatalf("expected %v, got %v", test.matches, matches)
+			}
+		})
+	}
+
+	if !(MongoDBIndex{Keys: bson.D{{Key: "user", Value: 1}}}).matches(existingIndex{Key: bson.D{{Key: "user", Value: int32(1)}}}) {
+		t.Fatal("expected an index without a partial filter to match")
+	}
+}
+
+func TestPlanIndexes(t *testing.T) {
+	var (
+		email = MongoDBIndex{Collection: CollectionUsers, Keys: bson.D{{Key: "email", Value: 1}}, Unique: true}
+		user  = MongoDBIndex{Collection: CollectionSessions, Keys: bson.D{{Key: "user", Value: 1}}}
+		hash  = MongoDBIndex{Collection: CollectionTokens, Keys: bson.D{{Key: "hash", Value: 1}}, Unique: true}
+		name  = MongoDBIndex{Collection: CollectionTokens, Keys: bson.D{{Key: "name", Value: 1}}}
+	)
+
+	existing := map[string]map[string]existingIndex{
+		CollectionUsers: {
+			"_id_": {Name: "_id_", Key: bson.D{{Key: "_id", Value: int32(1)}}},
+			// An index that has been rebuilt before has the alternate name.
+			"email_1_rebuilt": {Name: "email_1_rebuilt", Key: bson.D{{Key: "email", Value: int32(1)}}, Unique: true},
+			"createdAt_1":     {Name: "createdAt_1", Key: bson.D{{Key: "createdAt", Value: int32(1)}}},
+		},
+		CollectionTokens: {
+			"hash_1": {Name: "hash_1", Key: bson.D{{Key: "hash", Value: int32(1)}}},
+			// The old index was left behind after the rebuilt one was created.
+			"name_1":         {Name: "name_1", Key: bson.D{{Key: "name", Value: int32(1)}}, Unique: true},
+			"name_1_rebuilt": {Name: "name_1_rebuilt", Key: bson.D{{Key: "name", Value: int32(1)}}},
+		},
+	}
+
+	var (
+		result = planIndexes([]MongoDBIndex{email, user, hash, name}, existing)
+		plan   = make([]string, 0, len(result))
+	)
+
+	for _, drift := range result {
+		plan = append(plan, drift.String())
+	}
+
+	expected := []string{
+		"Index sessions.user_1 is missing",
+		"Index tokens.hash_1 is changed",
+		"Index users.createdAt_1 is not defined by the server",
+		"Index tokens.name_1 is not defined by the server",
+	}
+
+	if strings.Join(plan, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected the plan:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(plan, "\n"))
+	}
+}
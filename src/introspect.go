@@ -0,0 +1,224 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	introspectionCache *IntrospectionCache = NewIntrospectionCache()
+)
+
+// TokenIntrospection is the result of validating a raw API token. MatchedSecret is either current or previous,
+// depending on which secret of a rotated token the raw token is.
+type TokenIntrospection struct {
+	Active         bool     `json:"active"`
+	Application    string   `json:"application,omitempty"`
+	Token          string   `json:"token,omitempty"`
+	Scopes         []string `json:"scopes"`
+	RateLimitTier  string   `json:"rateLimitTier,omitempty"`
+	BurstPerSecond uint32   `json:"burstPerSecond,omitempty"`
+	OverQuota      bool     `json:"overQuota"`
+	MatchedSecret  string   `json:"matchedSecret,omitempty"`
+	TokenRestrictions
+	validUntil *time.Time
+}
+
+// IntrospectionCache is an in-process cache of token introspection results keyed by token hash.
+type IntrospectionCache struct {
+	entries   map[string]introspectionCacheEntry
+	lastSweep time.Time
+	mutex     *sync.Mutex
+}
+
+type introspectionCacheEntry struct {
+	value     *TokenIntrospection
+	expiresAt time.Time
+}
+
+// NewIntrospectionCache creates a new empty introspection cache.
+func NewIntrospectionCache() *IntrospectionCache {
+	return &IntrospectionCache{
+		entries:   make(map[string]introspectionCacheEntry),
+		lastSweep: time.Now(),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Get returns the cached result for the token hash, if one exists and has not expired.
+func (c *IntrospectionCache) Get(hash string) (*TokenIntrospection, bool) {
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[hash]
+
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, hash)
+
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+// Set caches the result for the token hash. Inactive results are cached for the shorter negative cache duration.
+func (c *IntrospectionCache) Set(hash string, value *TokenIntrospection) {
+	ttl := config.Internal.CacheTTL
+
+	if !value.Active {
+		ttl = config.Internal.NegativeCacheTTL
+	}
+
+	now := time.Now()
+
+	// A result must not outlive the secret it was made for, such as the previous secret of a rotated token.
+	if value.validUntil != nil && value.validUntil.Sub(now) < ttl {
+		ttl = value.validUntil.Sub(now)
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	if now.Sub(c.lastSweep) >= time.Minute {
+		for key, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+
+		c.lastSweep = now
+	}
+
+	c.entries[hash] = introspectionCacheEntry{
+		value:     value,
+		expiresAt: now.Add(ttl),
+	}
+}
+
+// Invalidate removes the cached result for the token hash.
+func (c *IntrospectionCache) Invalidate(hash string) {
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	delete(c.entries, hash)
+}
+
+// invalidateTokenCache removes the cached results for both the current and the previous secret of the token.
+func invalidateTokenCache(token *Token) {
+	introspectionCache.Invalidate(token.Hash)
+
+	if len(token.PreviousSecretHash) > 0 {
+		introspectionCache.Invalidate(token.PreviousSecretHash)
+	}
+}
+
+// IntrospectToken validates the raw API token and returns details about it, using the cache when possible.
+func IntrospectToken(store Store, rawToken string) (*TokenIntrospection, error) {
+	hash := HashAPIToken(rawToken)
+
+	if result, ok := introspectionCache.Get(hash); ok {
+		return result, nil
+	}
+
+	result, err := introspectTokenHash(store, hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	introspectionCache.Set(hash, result)
+
+	return result, nil
+}
+
+func introspectTokenHash(store Store, hash string) (*TokenIntrospection, error) {
+	token, err := store.GetTokenByHash(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if token == nil || token.DeletedAt != nil || token.Disabled || token.IsExpired(now) {
+		return &TokenIntrospection{Active: false, Scopes: make([]string, 0)}, nil
+	}
+
+	var (
+		matchedSecret = "current"
+		validUntil    = token.ExpiresAt
+	)
+
+	if token.Hash != hash {
+		if token.PreviousSecretExpiresAt == nil || !now.Before(*token.PreviousSecretExpiresAt) {
+			return &TokenIntrospection{Active: false, Scopes: make([]string, 0)}, nil
+		}
+
+		matchedSecret = "previous"
+
+		if validUntil == nil || token.PreviousSecretExpiresAt.Before(*validUntil) {
+			validUntil = token.PreviousSecretExpiresAt
+		}
+	}
+
+	application, err := store.GetApplicationByID(token.Application)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if application == nil || application.DeletedAt != nil {
+		return &TokenIntrospection{Active: false, Scopes: make([]string, 0)}, nil
+	}
+
+	quota, err := GetCachedApplicationQuota(store, application)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := token.Scopes
+
+	if scopes == nil {
+		scopes = make([]string, 0)
+	}
+
+	restrictions := token.TokenRestrictions
+
+	if restrictions.AllowedCIDRs == nil {
+		restrictions.AllowedCIDRs = make([]string, 0)
+	}
+
+	if restrictions.AllowedReferrers == nil {
+		restrictions.AllowedReferrers = make([]string, 0)
+	}
+
+	return &TokenIntrospection{
+		Active:            true,
+		Application:       application.ID,
+		Token:             token.ID,
+		Scopes:            scopes,
+		RateLimitTier:     quota.Plan,
+		BurstPerSecond:    quota.BurstPerSecond,
+		OverQuota:         quota.OverQuota,
+		MatchedSecret:     matchedSecret,
+		TokenRestrictions: restrictions,
+		validUntil:        validUntil,
+	}, nil
+}
+
+// HasScope returns whether the token has been granted the scope.
+func (t *TokenIntrospection) HasScope(scope string) bool {
+	return ContainsString(t.Scopes, scope)
+}
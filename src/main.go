@@ -2,9 +2,9 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 
 	"github.com/go-playground/validator/v10"
@@ -12,29 +12,20 @@ import (
 )
 
 var (
-	app *fiber.App = fiber.New(fiber.Config{
-		DisableStartupMessage: true,
-		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
-			var fiberError *fiber.Error
-
-			if errors.As(err, &fiberError) {
-				return ctx.SendStatus(fiberError.Code)
-			}
-
-			log.Printf("Error: %v - URI: %s\n", err, ctx.Request().URI())
-
-			return ctx.SendStatus(http.StatusInternalServerError)
-		},
-	})
-	db         *MongoDB            = &MongoDB{}
-	config     *Config             = DefaultConfig
-	instanceID uint16              = 0
-	validate   *validator.Validate = validator.New()
+	storeFlag      *string             = flag.String("store", "", "The storage backend to use, either mongodb, postgres, sqlite or memory, defaulting to the scheme of the database URI")
+	migrateToFlag  *int                = flag.Int("migrate-to", -1, "Migrates the SQL database schema up or down to the version and exits")
+	checkIndexes   *bool               = flag.Bool("check-indexes", false, "Reports differences between the expected and existing MongoDB indexes without changing them and exits")
+	config         *Config             = DefaultConfig
+	instanceID     uint16              = 0
+	validate       *validator.Validate = validator.New()
+	passwordHasher PasswordHasher      = nil
 )
 
-func init() {
+func main() {
 	var err error
 
+	flag.Parse()
+
 	if err = config.ReadFile("config.yml"); err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			panic(err)
@@ -49,21 +40,65 @@ func init() {
 		panic(err)
 	}
 
-	if err := db.Connect(config.MongoDB); err != nil {
+	if passwordHasher, err = NewPasswordHasher(config.Password); err != nil {
+		log.Fatalf("Failed to configure password hashing: %v", err)
+	}
+
+	if _, ok := config.Plans[config.DefaultPlan]; !ok {
+		panic(fmt.Errorf("default plan does not exist: %s", config.DefaultPlan))
+	}
+
+	if *migrateToFlag >= 0 {
+		if err = MigrateSQLStore(config.DatabaseURI(), *migrateToFlag); err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
+
+		log.Printf("Migrated database to version %d\n", *migrateToFlag)
+
+		os.Exit(0)
+	}
+
+	if *checkIndexes {
+		drift, err := CheckMongoDBIndexes(config.DatabaseURI())
+
+		if err != nil {
+			log.Fatalf("Failed to check indexes: %v", err)
+		}
+
+		if len(drift) > 0 {
+			log.Printf("Found %d differences between the expected and existing indexes\n", len(drift))
+
+			os.Exit(1)
+		}
+
+		log.Println("All indexes are up to date")
+
+		os.Exit(0)
+	}
+
+	store, err := NewStore(*storeFlag, config.DatabaseURI())
+
+	if err != nil {
 		panic(err)
 	}
 
-	log.Println("Successfully connected to MongoDB")
+	defer store.Close()
+
+	app := NewApp(store)
 
 	app.Hooks().OnListen(func(ld fiber.ListenData) error {
 		log.Printf("Listening on %s:%d\n", config.Host, config.Port+instanceID)
 
 		return nil
 	})
-}
 
-func main() {
-	defer db.Close()
+	// Token expiry notices are sent even when usage alerts are disabled.
+	if config.Alerts.Enabled || config.Tokens.ExpiryNoticePeriod > 0 {
+		(&AlertEvaluator{Store: store, Notifier: NewNotifier(store, config.Alerts), UsageAlerts: config.Alerts.Enabled}).Start()
+	}
+
+	(&WebhookDispatcher{Store: store, Client: NewWebhookClient(config.Webhooks.Timeout)}).Start()
+	(&Purger{Store: store}).Start()
 
 	if err := app.Listen(fmt.Sprintf("%s:%d", config.Host, config.Port+instanceID)); err != nil {
 		panic(err)
@@ -0,0 +1,1003 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MemoryStore is a thread-safe store that keeps every document in memory, for development and tests.
+// Nothing is persisted once the process exits.
+type MemoryStore struct {
+	mutex        sync.RWMutex
+	users        map[string]User
+	sessions     map[string]Session
+	applications map[string]Application
+	tokens       map[string]Token
+	requestLog   map[string]RequestLog
+	usageBatches map[string]memoryUsageBatch
+	preferences  map[string]NotificationPreferences
+	alerts       map[string]time.Time
+	webhooks     map[string]Webhook
+	deliveries   map[string]WebhookDelivery
+}
+
+// memoryUsageBatch is a claimed usage batch, which can be claimed again once its lease runs out unless it has been applied.
+type memoryUsageBatch struct {
+	lockedUntil time.Time
+	completed   bool
+}
+
+// NewMemoryStore returns an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:        make(map[string]User),
+		sessions:     make(map[string]Session),
+		applications: make(map[string]Application),
+		tokens:       make(map[string]Token),
+		requestLog:   make(map[string]RequestLog),
+		usageBatches: make(map[string]memoryUsageBatch),
+		preferences:  make(map[string]NotificationPreferences),
+		alerts:       make(map[string]time.Time),
+		webhooks:     make(map[string]Webhook),
+		deliveries:   make(map[string]WebhookDelivery),
+	}
+}
+
+func (s *MemoryStore) InsertUser(document User) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	if _, ok := s.users[document.ID]; ok {
+		return ErrDuplicateKey
+	}
+
+	for _, user := range s.users {
+		if user.Email == document.Email {
+			return ErrDuplicateKey
+		}
+	}
+
+	s.users[document.ID] = document
+
+	return nil
+}
+
+func (s *MemoryStore) InsertSession(document Session) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	if _, ok := s.sessions[document.ID]; ok {
+		return ErrDuplicateKey
+	}
+
+	s.sessions[document.ID] = document
+
+	return nil
+}
+
+func (s *MemoryStore) InsertApplication(document Application) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	if _, ok := s.applications[document.ID]; ok {
+		return ErrDuplicateKey
+	}
+
+	s.applications[document.ID] = document
+
+	return nil
+}
+
+func (s *MemoryStore) InsertToken(document Token) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	if _, ok := s.tokens[document.ID]; ok {
+		return ErrDuplicateKey
+	}
+
+	s.tokens[document.ID] = document
+
+	return nil
+}
+
+func (s *MemoryStore) InsertUsageBatch(id string) (bool, error) {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+
+	if batch, ok := s.usageBatches[id]; ok && (batch.completed || now.Before(batch.lockedUntil)) {
+		return false, nil
+	}
+
+	s.usageBatches[id] = memoryUsageBatch{lockedUntil: now.Add(UsageBatchLease)}
+
+	return true, nil
+}
+
+func (s *MemoryStore) InsertWebhook(document Webhook) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	if _, ok := s.webhooks[document.ID]; ok {
+		return ErrDuplicateKey
+	}
+
+	s.webhooks[document.ID] = document
+
+	return nil
+}
+
+func (s *MemoryStore) InsertWebhookDeliveries(documents []WebhookDelivery) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	for _, document := range documents {
+		if _, ok := s.deliveries[document.ID]; ok {
+			return ErrDuplicateKey
+		}
+	}
+
+	for _, document := range documents {
+		s.deliveries[document.ID] = document
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) InsertAlert(id, application string, expiresAt time.Time) (bool, error) {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	if existingExpiresAt, ok := s.alerts[id]; ok && time.Now().Before(existingExpiresAt) {
+		return false, nil
+	}
+
+	s.alerts[id] = expiresAt
+
+	return true, nil
+}
+
+func (s *MemoryStore) IncrementUsage(batchID string, increments []*UsageIncrement) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	if batch, ok := s.usageBatches[batchID]; ok {
+		if batch.completed {
+			return nil
+		}
+
+		batch.completed = true
+
+		s.usageBatches[batchID] = batch
+	}
+
+	for _, increment := range increments {
+		key := strings.Join([]string{increment.Application, increment.Token, increment.Timestamp.UTC().Format(time.RFC3339Nano)}, ":")
+
+		entry, ok := s.requestLog[key]
+
+		if !ok {
+			entry = RequestLog{
+				ID:          RandomHexString(12),
+				Application: increment.Application,
+				Token:       increment.Token,
+				Timestamp:   increment.Timestamp.UTC(),
+			}
+		}
+
+		entry.RequestCount += increment.RequestCount
+
+		s.requestLog[key] = entry
+
+		if token, ok := s.tokens[increment.Token]; ok {
+			token.RequestCount += uint64(increment.RequestCount)
+
+			if token.LastUsedAt == nil || increment.LastUsedAt.After(*token.LastUsedAt) {
+				lastUsedAt := increment.LastUsedAt
+
+				token.LastUsedAt = &lastUsedAt
+			}
+
+			s.tokens[increment.Token] = token
+		}
+
+		if application, ok := s.applications[increment.Application]; ok {
+			application.RequestCount += uint64(increment.RequestCount)
+
+			s.applications[increment.Application] = application
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetUserByEmail(email string) (*User, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	for _, user := range s.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) GetUserByID(id string) (*User, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	if user, ok := s.users[id]; ok {
+		return &user, nil
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) GetSessionByID(id string) (*Session, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	if session, ok := s.sessions[id]; ok {
+		return &session, nil
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) GetSessionsByUser(user string) ([]*Session, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	result := make([]*Session, 0)
+
+	for _, session := range s.sessions {
+		if session.User != user {
+			continue
+		}
+
+		session := session
+
+		result = append(result, &session)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if !result[i].LastUsedAt.Equal(result[j].LastUsedAt) {
+			return result[i].LastUsedAt.After(result[j].LastUsedAt)
+		}
+
+		return result[i].ID < result[j].ID
+	})
+
+	return result, nil
+}
+
+func (s *MemoryStore) GetTokenByID(id string) (*Token, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	if token, ok := s.tokens[id]; ok {
+		return &token, nil
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) GetTokenByHash(hash string) (*Token, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	for _, token := range s.tokens {
+		if token.Hash == hash || (len(token.PreviousSecretHash) > 0 && token.PreviousSecretHash == hash) {
+			return &token, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) GetTokenByApplicationAndID(application, id string) (*Token, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	if token, ok := s.tokens[id]; ok && token.Application == application {
+		return &token, nil
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) GetApplicationByID(id string) (*Application, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	if application, ok := s.applications[id]; ok {
+		return &application, nil
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) IterateApplications(fn func(*Application) error) error {
+	s.mutex.RLock()
+
+	applications := make([]Application, 0, len(s.applications))
+
+	for _, application := range s.applications {
+		applications = append(applications, application)
+	}
+
+	s.mutex.RUnlock()
+
+	for _, application := range applications {
+		application := application
+
+		if err := fn(&application); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetNotificationPreferences(application string) (*NotificationPreferences, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	if preferences, ok := s.preferences[application]; ok {
+		return &preferences, nil
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) GetWebhookByID(id string) (*Webhook, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	if webhook, ok := s.webhooks[id]; ok {
+		return &webhook, nil
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) GetWebhookByApplicationAndID(application, id string) (*Webhook, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	if webhook, ok := s.webhooks[id]; ok && webhook.Application == application {
+		return &webhook, nil
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) GetWebhooksByApplication(application string) ([]*Webhook, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	result := make([]*Webhook, 0)
+
+	for _, webhook := range s.webhooks {
+		if webhook.Application != application {
+			continue
+		}
+
+		webhook := webhook
+
+		result = append(result, &webhook)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.Before(result[j].CreatedAt)
+		}
+
+		return result[i].ID < result[j].ID
+	})
+
+	return result, nil
+}
+
+func (s *MemoryStore) GetWebhookDeliveriesByWebhook(webhook string, limit int64) ([]*WebhookDelivery, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	result := make([]*WebhookDelivery, 0)
+
+	for _, delivery := range s.deliveries {
+		if delivery.Webhook != webhook {
+			continue
+		}
+
+		delivery := delivery
+
+		result = append(result, &delivery)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.After(result[j].CreatedAt)
+		}
+
+		return result[i].ID < result[j].ID
+	})
+
+	if int64(len(result)) > limit {
+		result = result[:limit]
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) ClaimWebhookDelivery(now, lockedUntil time.Time) (*WebhookDelivery, error) {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	var claimed *WebhookDelivery
+
+	for _, delivery := range s.deliveries {
+		if delivery.Status != "pending" || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+
+		if delivery.LockedUntil != nil && delivery.LockedUntil.After(now) {
+			continue
+		}
+
+		if claimed == nil || delivery.NextAttemptAt.Before(claimed.NextAttemptAt) {
+			delivery := delivery
+
+			claimed = &delivery
+		}
+	}
+
+	if claimed == nil {
+		return nil, nil
+	}
+
+	claimed.LockedUntil = &lockedUntil
+
+	s.deliveries[claimed.ID] = *claimed
+
+	return claimed, nil
+}
+
+func (s *MemoryStore) GetDeletedApplications(before time.Time) ([]*Application, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	result := make([]*Application, 0)
+
+	for _, application := range s.applications {
+		if application.DeletedAt == nil || application.DeletedAt.After(before) {
+			continue
+		}
+
+		application := application
+
+		result = append(result, &application)
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) GetDeletedTokens(before time.Time) ([]*Token, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	result := make([]*Token, 0)
+
+	for _, token := range s.tokens {
+		if token.DeletedAt == nil || token.DeletedAt.After(before) {
+			continue
+		}
+
+		token := token
+
+		result = append(result, &token)
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) GetApplicationsByUser(user string, query *ListQuery) ([]*Application, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	result := make([]*Application, 0)
+
+	for _, application := range s.applications {
+		if application.User != user || application.DeletedAt != nil || !query.Matches(application.Name, application.CreatedAt) {
+			continue
+		}
+
+		if !query.After(application.SortValue(query.Sort), application.ID) {
+			continue
+		}
+
+		application := application
+
+		result = append(result, &application)
+	}
+
+	order := GetSortDirectionValue(query.Direction)
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if value := CompareSortValues(result[i].SortValue(query.Sort), result[j].SortValue(query.Sort)); value != 0 {
+			return value*order < 0
+		}
+
+		return result[i].ID < result[j].ID
+	})
+
+	if query.Limit > 0 && int64(len(result)) > query.Limit {
+		result = result[:query.Limit]
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) GetTokensByApplication(application string, query *ListQuery) ([]*Token, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	result := make([]*Token, 0)
+
+	for _, token := range s.tokens {
+		if token.Application != application || token.DeletedAt != nil || !query.Matches(token.Name, token.CreatedAt) {
+			continue
+		}
+
+		if !query.After(token.SortValue(query.Sort), token.ID) {
+			continue
+		}
+
+		token := token
+
+		result = append(result, &token)
+	}
+
+	order := GetSortDirectionValue(query.Direction)
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if value := CompareSortValues(result[i].SortValue(query.Sort), result[j].SortValue(query.Sort)); value != 0 {
+			return value*order < 0
+		}
+
+		return result[i].ID < result[j].ID
+	})
+
+	if query.Limit > 0 && int64(len(result)) > query.Limit {
+		result = result[:query.Limit]
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) GetRequestLogBuckets(query *UsageQuery) ([]*RequestLogBucket, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	entries := make([]RequestLog, 0)
+
+	for _, entry := range s.requestLog {
+		if !s.matchesRequestLog(entry, query.Application, query.From, query.To) {
+			continue
+		}
+
+		if len(query.Token) > 0 && entry.Token != query.Token {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return BucketRequestLogs(query, entries), nil
+}
+
+func (s *MemoryStore) SumRequestLogs(application string, from, to time.Time) (int64, error) {
+	s.mutex.RLock()
+
+	defer s.mutex.RUnlock()
+
+	var result int64 = 0
+
+	for _, entry := range s.requestLog {
+		if s.matchesRequestLog(entry, application, from, to) {
+			result += entry.RequestCount
+		}
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) IterateRequestLogExport(query *UsageQuery, group string, fn func(*RequestLogBucket) error) error {
+	s.mutex.RLock()
+
+	var (
+		buckets = make(map[string]*RequestLogBucket)
+		rows    = make([]*RequestLogBucket, 0)
+	)
+
+	for _, entry := range s.requestLog {
+		if !s.matchesRequestLog(entry, query.Application, query.From, query.To) {
+			continue
+		}
+
+		var (
+			key    string
+			bucket = &RequestLogBucket{}
+		)
+
+		switch group {
+		case "token":
+			key = entry.Token
+			bucket.Token = entry.Token
+		case "interval":
+			bucket.Timestamp = TruncateUsageTime(entry.Timestamp, query.Interval, query.Location).UTC()
+			key = bucket.Timestamp.Format(time.RFC3339)
+		default:
+			bucket.Token = entry.Token
+			bucket.Timestamp = entry.Timestamp
+			key = entry.ID
+		}
+
+		if _, ok := buckets[key]; !ok {
+			buckets[key] = bucket
+
+			rows = append(rows, bucket)
+		}
+
+		buckets[key].RequestCount += entry.RequestCount
+	}
+
+	s.mutex.RUnlock()
+
+	sortRequestLogBuckets(rows)
+
+	for _, row := range rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) UpsertNotificationPreferences(document NotificationPreferences) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	s.preferences[document.Application] = document
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateWebhookDeliveryByID(id string, fields Fields) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	delivery, ok := s.deliveries[id]
+
+	if !ok {
+		return nil
+	}
+
+	if err := applyFields(&delivery, fields); err != nil {
+		return err
+	}
+
+	s.deliveries[id] = delivery
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateUserByID(id string, fields Fields) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	user, ok := s.users[id]
+
+	if !ok {
+		return nil
+	}
+
+	if err := applyFields(&user, fields); err != nil {
+		return err
+	}
+
+	s.users[id] = user
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateSessionByID(id string, fields Fields) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	session, ok := s.sessions[id]
+
+	if !ok {
+		return nil
+	}
+
+	if err := applyFields(&session, fields); err != nil {
+		return err
+	}
+
+	s.sessions[id] = session
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateApplicationByID(id string, fields Fields) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	application, ok := s.applications[id]
+
+	if !ok {
+		return nil
+	}
+
+	if err := applyFields(&application, fields); err != nil {
+		return err
+	}
+
+	s.applications[id] = application
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateTokenByID(id string, fields Fields) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	token, ok := s.tokens[id]
+
+	if !ok {
+		return nil
+	}
+
+	if err := applyFields(&token, fields); err != nil {
+		return err
+	}
+
+	s.tokens[id] = token
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteSessionByID(id string) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, id)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteSessionByPublicID(user, publicID string) (bool, error) {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	for id, session := range s.sessions {
+		if session.User == user && session.PublicID == publicID {
+			delete(s.sessions, id)
+
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *MemoryStore) DeleteSessionsByUser(user, exceptID string) (int64, error) {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	var deleted int64 = 0
+
+	for id, session := range s.sessions {
+		if session.User == user && id != exceptID {
+			delete(s.sessions, id)
+
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (s *MemoryStore) DeleteUsageBatch(id string) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	delete(s.usageBatches, id)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteAlert(id string) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	delete(s.alerts, id)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteWebhookByID(id string) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	delete(s.webhooks, id)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteTokenByID(id string) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	delete(s.tokens, id)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteApplication(id string, purgeRequestLog bool) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	s.deleteApplication(id, purgeRequestLog)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteUser(id string, deletedAt time.Time) error {
+	s.mutex.Lock()
+
+	defer s.mutex.Unlock()
+
+	for applicationID, application := range s.applications {
+		if application.User == id && application.DeletedAt == nil {
+			application.DeletedAt = &deletedAt
+
+			s.applications[applicationID] = application
+		}
+	}
+
+	for sessionID, session := range s.sessions {
+		if session.User == id {
+			delete(s.sessions, sessionID)
+		}
+	}
+
+	delete(s.users, id)
+
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// deleteApplication removes the application and the documents that belong to it the same way as the MongoDB
+// store does. The caller must hold the write lock.
+func (s *MemoryStore) deleteApplication(id string, purgeRequestLog bool) {
+	for tokenID, token := range s.tokens {
+		if token.Application == id {
+			delete(s.tokens, tokenID)
+		}
+	}
+
+	for deliveryID, delivery := range s.deliveries {
+		if delivery.Application == id {
+			delete(s.deliveries, deliveryID)
+		}
+	}
+
+	for webhookID, webhook := range s.webhooks {
+		if webhook.Application == id {
+			delete(s.webhooks, webhookID)
+		}
+	}
+
+	for alertID := range s.alerts {
+		if strings.HasPrefix(alertID, id+":") {
+			delete(s.alerts, alertID)
+		}
+	}
+
+	if purgeRequestLog {
+		for key, entry := range s.requestLog {
+			if entry.Application == id {
+				delete(s.requestLog, key)
+			}
+		}
+	}
+
+	delete(s.preferences, id)
+	delete(s.applications, id)
+}
+
+func (s *MemoryStore) matchesRequestLog(entry RequestLog, application string, from, to time.Time) bool {
+	return entry.Application == application && !entry.Timestamp.Before(from) && entry.Timestamp.Before(to)
+}
+
+// applyFields sets the fields on the document the same way a MongoDB $set would, by round-tripping the
+// document through BSON so that the field names match those used by the other stores.
+func applyFields(document interface{}, fields Fields) error {
+	data, err := bson.Marshal(document)
+
+	if err != nil {
+		return err
+	}
+
+	values := bson.M{}
+
+	if err := bson.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	for key, value := range fields {
+		values[key] = value
+	}
+
+	if data, err = bson.Marshal(values); err != nil {
+		return err
+	}
+
+	return bson.Unmarshal(data, document)
+}
@@ -1,51 +1,135 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+// requestStore is the store as it is passed to the handlers of a request.
+type requestStore struct {
+	Store
+}
+
+// Close does nothing, since fasthttp closes every io.Closer in the locals of a request once it is done.
+func (requestStore) Close() error {
+	return nil
+}
+
+func StoreMiddleware(store Store) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		ctx.Locals("store", requestStore{store})
+
+		return ctx.Next()
+	}
+}
+
 func AuthenticateMiddleware() fiber.Handler {
+	return authenticate(false)
+}
+
+// OptionalAuthenticateMiddleware authenticates the request like AuthenticateMiddleware, but treats an invalid,
+// expired or restricted credential as if none was given, for public endpoints that show more to the owner.
+func OptionalAuthenticateMiddleware() fiber.Handler {
+	return authenticate(true)
+}
+
+func authenticate(optional bool) fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
+		store := ctx.Locals("store").(Store)
+
 		sessionToken := ctx.Get("Authorization")
 
 		if len(sessionToken) < 1 {
+			return anonymous(ctx)
+		}
+
+		// API tokens can authenticate requests too, but they are only accepted by endpoints that check for a scope.
+		if strings.HasPrefix(sessionToken, "mcs_") {
+			introspection, err := IntrospectToken(store, sessionToken)
+
+			if err != nil {
+				return err
+			}
+
+			if !introspection.Active {
+				if optional {
+					return anonymous(ctx)
+				}
+
+				return ctx.Status(http.StatusForbidden).SendString("Invalid token")
+			}
+
+			if err := introspection.Allows(ctx.IP(), ctx.Get("Referer")); err != nil {
+				if optional {
+					return anonymous(ctx)
+				}
+
+				return ctx.Status(http.StatusForbidden).SendString(fmt.Sprintf("Forbidden: %s", err))
+			}
+
 			ctx.Locals("authUser", nil)
+			ctx.Locals("session", nil)
+			ctx.Locals("authToken", introspection)
 
 			return ctx.Next()
 		}
 
-		session, err := db.GetSessionByID(sessionToken)
+		session, err := GetActiveSession(store, sessionToken)
+
+		if errors.Is(err, ErrSessionExpired) {
+			if optional {
+				return anonymous(ctx)
+			}
+
+			return ctx.Status(http.StatusUnauthorized).SendString("Session has expired")
+		}
 
 		if err != nil {
 			return err
 		}
 
 		if session == nil {
-			return ctx.Status(http.StatusForbidden).SendString("Invalid or expired session")
+			if optional {
+				return anonymous(ctx)
+			}
+
+			return ctx.Status(http.StatusForbidden).SendString("Invalid session")
 		}
 
-		user, err := db.GetUserByID(session.User)
+		user, err := store.GetUserByID(session.User)
 
 		if err != nil {
 			return err
 		}
 
 		if user == nil {
-			ctx.Locals("authUser", nil)
-
-			return ctx.Next()
+			return anonymous(ctx)
 		}
 
 		ctx.Locals("authUser", user)
+		ctx.Locals("session", session)
 
 		return ctx.Next()
 	}
 }
 
+// anonymous continues with the request as if no credential was given.
+func anonymous(ctx *fiber.Ctx) error {
+	ctx.Locals("authUser", nil)
+	ctx.Locals("session", nil)
+
+	return ctx.Next()
+}
+
 func GetUserMiddleware(param string) fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
+		store := ctx.Locals("store").(Store)
+
 		userID := ctx.Params(param)
 
 		if userID == "@me" {
@@ -63,20 +147,24 @@ func GetUserMiddleware(param string) fiber.Handler {
 				return ctx.Status(http.StatusUnauthorized).SendString("Missing Authorization header")
 			}
 
-			session, err := db.GetSessionByID(sessionToken)
+			session, err := GetActiveSession(store, sessionToken)
+
+			if errors.Is(err, ErrSessionExpired) {
+				return ctx.Status(http.StatusUnauthorized).SendString("Session has expired")
+			}
 
 			if err != nil {
 				return err
 			}
 
 			if session == nil {
-				return ctx.Status(http.StatusForbidden).SendString("Invalid or expired session")
+				return ctx.Status(http.StatusForbidden).SendString("Invalid session")
 			}
 
 			userID = session.User
 		}
 
-		user, err := db.GetUserByID(userID)
+		user, err := store.GetUserByID(userID)
 
 		if err != nil {
 			return err
@@ -94,13 +182,15 @@ func GetUserMiddleware(param string) fiber.Handler {
 
 func GetApplicationMiddleware(param string) fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
-		app, err := db.GetApplicationByID(ctx.Params(param))
+		store := ctx.Locals("store").(Store)
+
+		app, err := store.GetApplicationByID(ctx.Params(param))
 
 		if err != nil {
 			return err
 		}
 
-		if app == nil {
+		if app == nil || app.DeletedAt != nil {
 			return ctx.Status(http.StatusNotFound).SendString("No application found by that ID")
 		}
 
@@ -110,6 +200,104 @@ func GetApplicationMiddleware(param string) fiber.Handler {
 	}
 }
 
+func GetTokenMiddleware(param string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		store := ctx.Locals("store").(Store)
+
+		app, ok := ctx.Locals("application").(*Application)
+
+		if !ok || app == nil {
+			return ctx.Status(http.StatusNotFound).SendString("Application not found")
+		}
+
+		token, err := store.GetTokenByApplicationAndID(app.ID, ctx.Params(param))
+
+		if err != nil {
+			return err
+		}
+
+		if token == nil || token.DeletedAt != nil {
+			return ctx.Status(http.StatusNotFound).SendString("No token was found by that ID")
+		}
+
+		ctx.Locals("token", token)
+
+		return ctx.Next()
+	}
+}
+
+func GetDeletedApplicationMiddleware(param string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		store := ctx.Locals("store").(Store)
+
+		app, err := store.GetApplicationByID(ctx.Params(param))
+
+		if err != nil {
+			return err
+		}
+
+		if app == nil || app.DeletedAt == nil {
+			return ctx.Status(http.StatusNotFound).SendString("No deleted application found by that ID")
+		}
+
+		ctx.Locals("application", app)
+
+		return ctx.Next()
+	}
+}
+
+func GetDeletedTokenMiddleware(param string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		store := ctx.Locals("store").(Store)
+
+		app, ok := ctx.Locals("application").(*Application)
+
+		if !ok || app == nil {
+			return ctx.Status(http.StatusNotFound).SendString("Application not found")
+		}
+
+		token, err := store.GetTokenByApplicationAndID(app.ID, ctx.Params(param))
+
+		if err != nil {
+			return err
+		}
+
+		if token == nil || token.DeletedAt == nil {
+			return ctx.Status(http.StatusNotFound).SendString("No deleted token was found by that ID")
+		}
+
+		ctx.Locals("token", token)
+
+		return ctx.Next()
+	}
+}
+
+func GetWebhookMiddleware(param string) fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		store := ctx.Locals("store").(Store)
+
+		app, ok := ctx.Locals("application").(*Application)
+
+		if !ok || app == nil {
+			return ctx.Status(http.StatusNotFound).SendString("Application not found")
+		}
+
+		webhook, err := store.GetWebhookByApplicationAndID(app.ID, ctx.Params(param))
+
+		if err != nil {
+			return err
+		}
+
+		if webhook == nil {
+			return ctx.Status(http.StatusNotFound).SendString("No webhook was found by that ID")
+		}
+
+		ctx.Locals("webhook", webhook)
+
+		return ctx.Next()
+	}
+}
+
 func RequireAuthMiddleware() fiber.Handler {
 	return func(ctx *fiber.Ctx) error {
 		authUser, ok := ctx.Locals("authUser").(*User)
@@ -165,3 +353,43 @@ func ApplicationAuthMiddleware() fiber.Handler {
 		return ctx.Status(http.StatusForbidden).SendString("You must be authorized to access this endpoint")
 	}
 }
+
+// ApplicationScopeMiddleware allows the owner of the application, as well as API tokens of the application that
+// have been granted the scope.
+func ApplicationScopeMiddleware(scope string) fiber.Handler {
+	applicationAuth := ApplicationAuthMiddleware()
+
+	return func(ctx *fiber.Ctx) error {
+		introspection, ok := ctx.Locals("authToken").(*TokenIntrospection)
+
+		if !ok || introspection == nil {
+			return applicationAuth(ctx)
+		}
+
+		app, ok := ctx.Locals("application").(*Application)
+
+		if !ok || app == nil {
+			return ctx.Status(http.StatusNotFound).SendString("Application not found")
+		}
+
+		if introspection.Application != app.ID || !introspection.HasScope(scope) {
+			return ctx.Status(http.StatusForbidden).SendString(fmt.Sprintf("The token must have the %s scope to access this endpoint", scope))
+		}
+
+		return ctx.Next()
+	}
+}
+
+func InternalAuthMiddleware() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		if len(config.Internal.Secret) < 1 {
+			return ctx.Status(http.StatusNotFound).SendString("Internal endpoints are disabled")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(ctx.Get("Authorization")), []byte(config.Internal.Secret)) != 1 {
+			return ctx.Status(http.StatusUnauthorized).SendString("You must be authorized to access this endpoint")
+		}
+
+		return ctx.Next()
+	}
+}
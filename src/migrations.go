@@ -0,0 +1,225 @@
+package main
+
+var (
+	// SQLMigrations are the versioned changes to the schema of the SQL store, in the order they are applied.
+	// Every statement must be valid in both PostgreSQL and SQLite. Times are stored as Unix milliseconds.
+	SQLMigrations []SQLMigration = []SQLMigration{
+		{
+			Version: 1,
+			Up: []string{
+				`CREATE TABLE users (
+					id TEXT PRIMARY KEY,
+					email TEXT NOT NULL,
+					password TEXT NOT NULL,
+					type TEXT NOT NULL,
+					created_at BIGINT NOT NULL
+				)`,
+				`CREATE INDEX users_email ON users (email)`,
+				`CREATE TABLE sessions (
+					id TEXT PRIMARY KEY,
+					public_id TEXT NOT NULL,
+					user_id TEXT NOT NULL,
+					ip TEXT NOT NULL,
+					user_agent TEXT NOT NULL,
+					created_at BIGINT NOT NULL,
+					last_used_at BIGINT NOT NULL,
+					expires_at BIGINT
+				)`,
+				`CREATE INDEX sessions_user ON sessions (user_id)`,
+				`CREATE INDEX sessions_expires_at ON sessions (expires_at)`,
+				`CREATE TABLE applications (
+					id TEXT PRIMARY KEY,
+					name TEXT NOT NULL,
+					short_description TEXT NOT NULL,
+					user_id TEXT NOT NULL,
+					token_prefix TEXT NOT NULL,
+					token_hash TEXT NOT NULL,
+					plan TEXT NOT NULL,
+					request_count BIGINT NOT NULL DEFAULT 0,
+					created_at BIGINT NOT NULL
+				)`,
+				`CREATE INDEX applications_user ON applications (user_id)`,
+				`CREATE TABLE tokens (
+					id TEXT PRIMARY KEY,
+					name TEXT NOT NULL,
+					prefix TEXT NOT NULL,
+					hash TEXT NOT NULL,
+					request_count BIGINT NOT NULL DEFAULT 0,
+					application TEXT NOT NULL,
+					created_at BIGINT NOT NULL,
+					last_used_at BIGINT
+				)`,
+				`CREATE UNIQUE INDEX tokens_hash ON tokens (hash)`,
+				`CREATE INDEX tokens_application ON tokens (application)`,
+				`CREATE TABLE request_log (
+					id TEXT PRIMARY KEY,
+					application TEXT NOT NULL,
+					token TEXT NOT NULL,
+					timestamp BIGINT NOT NULL,
+					request_count BIGINT NOT NULL,
+					UNIQUE (application, token, timestamp)
+				)`,
+				`CREATE INDEX request_log_application_timestamp ON request_log (application, timestamp)`,
+				`CREATE TABLE usage_batches (
+					id TEXT PRIMARY KEY,
+					created_at BIGINT NOT NULL
+				)`,
+				`CREATE INDEX usage_batches_created_at ON usage_batches (created_at)`,
+				`CREATE TABLE notification_preferences (
+					application TEXT PRIMARY KEY,
+					email BOOLEAN NOT NULL,
+					webhook_url TEXT NOT NULL,
+					webhook_secret TEXT NOT NULL,
+					quota_alerts BOOLEAN NOT NULL,
+					spike_alerts BOOLEAN NOT NULL
+				)`,
+				`CREATE TABLE alerts (
+					id TEXT PRIMARY KEY,
+					application TEXT NOT NULL,
+					created_at BIGINT NOT NULL,
+					expires_at BIGINT NOT NULL
+				)`,
+				`CREATE TABLE webhooks (
+					id TEXT PRIMARY KEY,
+					application TEXT NOT NULL,
+					url TEXT NOT NULL,
+					secret TEXT NOT NULL,
+					events TEXT NOT NULL,
+					created_at BIGINT NOT NULL
+				)`,
+				`CREATE INDEX webhooks_application ON webhooks (application)`,
+				`CREATE TABLE webhook_deliveries (
+					id TEXT PRIMARY KEY,
+					webhook TEXT NOT NULL,
+					application TEXT NOT NULL,
+					event TEXT NOT NULL,
+					url TEXT NOT NULL,
+					payload TEXT NOT NULL,
+					status TEXT NOT NULL,
+					attempts INTEGER NOT NULL,
+					next_attempt_at BIGINT NOT NULL,
+					locked_until BIGINT,
+					last_error TEXT NOT NULL,
+					response_status INTEGER NOT NULL,
+					created_at BIGINT NOT NULL,
+					delivered_at BIGINT
+				)`,
+				`CREATE INDEX webhook_deliveries_status_next_attempt_at ON webhook_deliveries (status, next_attempt_at)`,
+				`CREATE INDEX webhook_deliveries_webhook_created_at ON webhook_deliveries (webhook, created_at)`,
+			},
+			Down: []string{
+				`DROP TABLE webhook_deliveries`,
+				`DROP TABLE webhooks`,
+				`DROP TABLE alerts`,
+				`DROP TABLE notification_preferences`,
+				`DROP TABLE usage_batches`,
+				`DROP TABLE request_log`,
+				`DROP TABLE tokens`,
+				`DROP TABLE applications`,
+				`DROP TABLE sessions`,
+				`DROP TABLE users`,
+			},
+		},
+		{
+			Version: 2,
+			Up: []string{
+				`DROP INDEX users_email`,
+				`CREATE UNIQUE INDEX users_email ON users (email)`,
+			},
+			Down: []string{
+				`DROP INDEX users_email`,
+				`CREATE INDEX users_email ON users (email)`,
+			},
+		},
+		{
+			Version: 3,
+			Up: []string{
+				`ALTER TABLE applications ADD COLUMN deleted_at BIGINT`,
+				`ALTER TABLE tokens ADD COLUMN deleted_at BIGINT`,
+				`CREATE INDEX applications_deleted_at ON applications (deleted_at)`,
+				`CREATE INDEX tokens_deleted_at ON tokens (deleted_at)`,
+			},
+			Down: []string{
+				`DROP INDEX tokens_deleted_at`,
+				`DROP INDEX applications_deleted_at`,
+				`ALTER TABLE tokens DROP COLUMN deleted_at`,
+				`ALTER TABLE applications DROP COLUMN deleted_at`,
+			},
+		},
+		{
+			Version: 4,
+			Up: []string{
+				`ALTER TABLE tokens ADD COLUMN previous_secret_hash TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE tokens ADD COLUMN previous_secret_expires_at BIGINT`,
+				`CREATE INDEX tokens_previous_secret_hash ON tokens (previous_secret_hash)`,
+			},
+			Down: []string{
+				`DROP INDEX tokens_previous_secret_hash`,
+				`ALTER TABLE tokens DROP COLUMN previous_secret_expires_at`,
+				`ALTER TABLE tokens DROP COLUMN previous_secret_hash`,
+			},
+		},
+		{
+			Version: 5,
+			Up: []string{
+				`ALTER TABLE tokens ADD COLUMN expires_at BIGINT`,
+			},
+			Down: []string{
+				`ALTER TABLE tokens DROP COLUMN expires_at`,
+			},
+		},
+		{
+			Version: 6,
+			Up: []string{
+				`ALTER TABLE tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT '["status:java","status:bedrock","icon:read"]'`,
+			},
+			Down: []string{
+				`ALTER TABLE tokens DROP COLUMN scopes`,
+			},
+		},
+		{
+			Version: 7,
+			Up: []string{
+				`ALTER TABLE tokens ADD COLUMN allowed_cidrs TEXT NOT NULL DEFAULT '[]'`,
+				`ALTER TABLE tokens ADD COLUMN allowed_referrers TEXT NOT NULL DEFAULT '[]'`,
+			},
+			Down: []string{
+				`ALTER TABLE tokens DROP COLUMN allowed_referrers`,
+				`ALTER TABLE tokens DROP COLUMN allowed_cidrs`,
+			},
+		},
+		{
+			Version: 8,
+			Up: []string{
+				`ALTER TABLE tokens ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+			},
+			Down: []string{
+				`ALTER TABLE tokens DROP COLUMN disabled`,
+			},
+		},
+		{
+			Version: 9,
+			Up: []string{
+				`ALTER TABLE usage_batches ADD COLUMN locked_until BIGINT NOT NULL DEFAULT 0`,
+				// Batches claimed before this migration were either applied or released, so they are marked as applied.
+				`ALTER TABLE usage_batches ADD COLUMN completed BOOLEAN NOT NULL DEFAULT TRUE`,
+			},
+			Down: []string{
+				`ALTER TABLE usage_batches DROP COLUMN completed`,
+				`ALTER TABLE usage_batches DROP COLUMN locked_until`,
+			},
+		},
+	}
+)
+
+// SQLMigration is a single versioned change to the schema of the SQL store, along with the statements that revert it.
+type SQLMigration struct {
+	Version int
+	Up      []string
+	Down    []string
+}
+
+// LatestSQLMigration returns the version of the most recent migration.
+func LatestSQLMigration() int {
+	return SQLMigrations[len(SQLMigrations)-1].Version
+}
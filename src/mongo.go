@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
@@ -18,11 +21,17 @@ var (
 	CollectionApplications string = "applications"
 	CollectionTokens       string = "tokens"
 	CollectionRequestLog   string = "request_log"
+	CollectionUsageBatches string = "usage_batches"
+	CollectionPreferences  string = "notification_preferences"
+	CollectionAlerts       string = "alerts"
+	CollectionWebhooks     string = "webhooks"
+	CollectionDeliveries   string = "webhook_deliveries"
 )
 
 type MongoDB struct {
-	Client   *mongo.Client
-	Database *mongo.Database
+	Client       *mongo.Client
+	Database     *mongo.Database
+	Transactions bool
 }
 
 type User struct {
@@ -34,29 +43,45 @@ type User struct {
 }
 
 type Session struct {
-	ID        string    `bson:"_id" json:"id"`
-	User      string    `bson:"user" json:"user"`
-	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	ID         string     `bson:"_id" json:"id"`
+	PublicID   string     `bson:"publicId" json:"publicId"`
+	User       string     `bson:"user" json:"user"`
+	IP         string     `bson:"ip" json:"ip"`
+	UserAgent  string     `bson:"userAgent" json:"userAgent"`
+	CreatedAt  time.Time  `bson:"createdAt" json:"createdAt"`
+	LastUsedAt time.Time  `bson:"lastUsedAt" json:"lastUsedAt"`
+	ExpiresAt  *time.Time `bson:"expiresAt,omitempty" json:"expiresAt"`
 }
 
 type Application struct {
-	ID               string    `bson:"_id" json:"id"`
-	Name             string    `bson:"name" json:"name"`
-	ShortDescription string    `bson:"shortDescription" json:"shortDescription"`
-	User             string    `bson:"user" json:"user"`
-	Token            string    `bson:"token" json:"token"`
-	RequestCount     uint64    `bson:"requestCount" json:"requestCount"`
-	CreatedAt        time.Time `bson:"createdAt" json:"createdAt"`
+	ID               string     `bson:"_id" json:"id"`
+	Name             string     `bson:"name" json:"name"`
+	ShortDescription string     `bson:"shortDescription" json:"shortDescription"`
+	User             string     `bson:"user" json:"user"`
+	TokenPrefix      string     `bson:"tokenPrefix" json:"tokenPrefix"`
+	TokenHash        string     `bson:"tokenHash" json:"-"`
+	Plan             string     `bson:"plan" json:"plan"`
+	RequestCount     uint64     `bson:"requestCount" json:"requestCount"`
+	CreatedAt        time.Time  `bson:"createdAt" json:"createdAt"`
+	DeletedAt        *time.Time `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
 }
 
 type Token struct {
-	ID           string     `bson:"_id" json:"id"`
-	Name         string     `bson:"name" json:"name"`
-	Token        string     `bson:"token" json:"token"`
-	RequestCount uint64     `bson:"requestCount" json:"requestCount"`
-	Application  string     `bson:"application" json:"application"`
-	CreatedAt    time.Time  `bson:"createdAt" json:"createdAt"`
-	LastUsedAt   *time.Time `bson:"lastUsedAt" json:"lastUsedAt"`
+	ID                      string     `bson:"_id" json:"id"`
+	Name                    string     `bson:"name" json:"name"`
+	Prefix                  string     `bson:"prefix" json:"prefix"`
+	Hash                    string     `bson:"hash" json:"-"`
+	RequestCount            uint64     `bson:"requestCount" json:"requestCount"`
+	Application             string     `bson:"application" json:"application"`
+	CreatedAt               time.Time  `bson:"createdAt" json:"createdAt"`
+	LastUsedAt              *time.Time `bson:"lastUsedAt" json:"lastUsedAt"`
+	DeletedAt               *time.Time `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	PreviousSecretHash      string     `bson:"previousSecretHash,omitempty" json:"-"`
+	PreviousSecretExpiresAt *time.Time `bson:"previousSecretExpiresAt,omitempty" json:"previousSecretExpiresAt,omitempty"`
+	ExpiresAt               *time.Time `bson:"expiresAt,omitempty" json:"expiresAt"`
+	Scopes                  []string   `bson:"scopes" json:"scopes"`
+	Disabled                bool       `bson:"disabled" json:"disabled"`
+	TokenRestrictions       `bson:",inline"`
 }
 
 type RequestLog struct {
@@ -67,6 +92,12 @@ type RequestLog struct {
 	RequestCount int64     `bson:"requestCount" json:"requestCount"`
 }
 
+type RequestLogBucket struct {
+	Token        string    `bson:"token" json:"token"`
+	Timestamp    time.Time `bson:"timestamp" json:"timestamp"`
+	RequestCount int64     `bson:"requestCount" json:"requestCount"`
+}
+
 func (c *MongoDB) Connect(uri string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
@@ -88,12 +119,96 @@ func (c *MongoDB) Connect(uri string) error {
 		return err
 	}
 
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+
+	if err := client.Database("admin").RunCommand(ctx, bson.M{"hello": 1}).Decode(&hello); err != nil {
+		return err
+	}
+
 	c.Client = client
 	c.Database = client.Database(strings.TrimPrefix(parsedURI.Path, "/"))
+	// Transactions are only supported by replica sets and sharded clusters.
+	c.Transactions = len(hello.SetName) > 0 || hello.Msg == "isdbgrid"
 
 	return nil
 }
 
+func (c *MongoDB) MigratePlaintextTokens() (int64, error) {
+	tokens, err := c.migratePlaintextTokens(CollectionTokens, "hash", "prefix")
+
+	if err != nil {
+		return tokens, err
+	}
+
+	applications, err := c.migratePlaintextTokens(CollectionApplications, "tokenHash", "tokenPrefix")
+
+	return tokens + applications, err
+}
+
+func (c *MongoDB) migratePlaintextTokens(collection, hashField, prefixField string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	defer cancel()
+
+	cur, err := c.Database.Collection(collection).Find(ctx, bson.M{"token": bson.M{"$exists": true}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer cur.Close(ctx)
+
+	var migrated int64 = 0
+
+	for cur.Next(ctx) {
+		var document struct {
+			ID    string `bson:"_id"`
+			Token string `bson:"token"`
+		}
+
+		if err := cur.Decode(&document); err != nil {
+			return migrated, err
+		}
+
+		prefix := document.Token
+
+		if len(prefix) > 8 {
+			prefix = prefix[:8]
+		}
+
+		if _, err := c.Database.Collection(collection).UpdateOne(ctx, bson.M{"_id": document.ID}, bson.M{
+			"$set": bson.M{
+				hashField:   HashAPIToken(document.Token),
+				prefixField: prefix,
+			},
+			"$unset": bson.M{"token": ""},
+		}); err != nil {
+			return migrated, err
+		}
+
+		migrated++
+	}
+
+	return migrated, cur.Err()
+}
+
+func (c *MongoDB) MigrateTokenScopes() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	defer cancel()
+
+	result, err := c.Database.Collection(CollectionTokens).UpdateMany(ctx, bson.M{"scopes": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"scopes": DefaultTokenScopes}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.ModifiedCount, nil
+}
+
 func (c *MongoDB) InsertUser(document User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
@@ -101,6 +216,10 @@ func (c *MongoDB) InsertUser(document User) error {
 
 	_, err := c.Database.Collection(CollectionUsers).InsertOne(ctx, document)
 
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateKey
+	}
+
 	return err
 }
 
@@ -111,6 +230,10 @@ func (c *MongoDB) InsertSession(document Session) error {
 
 	_, err := c.Database.Collection(CollectionSessions).InsertOne(ctx, document)
 
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateKey
+	}
+
 	return err
 }
 
@@ -121,6 +244,10 @@ func (c *MongoDB) InsertApplication(document Application) error {
 
 	_, err := c.Database.Collection(CollectionApplications).InsertOne(ctx, document)
 
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateKey
+	}
+
 	return err
 }
 
@@ -131,66 +258,298 @@ func (c *MongoDB) InsertToken(document Token) error {
 
 	_, err := c.Database.Collection(CollectionTokens).InsertOne(ctx, document)
 
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateKey
+	}
+
 	return err
 }
 
-func (c *MongoDB) GetUserByEmail(email string) (*User, error) {
-
+func (c *MongoDB) InsertUsageBatch(id string) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 	defer cancel()
 
-	cur := c.Database.Collection(CollectionUsers).FindOne(ctx, bson.M{"email": email})
+	now := time.Now().UTC()
 
-	if err := cur.Err(); err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, nil
+	_, err := c.Database.Collection(CollectionUsageBatches).InsertOne(ctx, bson.M{"_id": id, "createdAt": now, "lockedUntil": now.Add(UsageBatchLease)})
+
+	if mongo.IsDuplicateKeyError(err) {
+		// A batch that failed part of the way through, or whose lease ran out before it was applied, is claimed
+		// again so that the retry can finish it.
+		result, err := c.Database.Collection(CollectionUsageBatches).UpdateOne(
+			ctx,
+			bson.M{
+				"_id":       id,
+				"completed": bson.M{"$ne": true},
+				"$or":       bson.A{bson.M{"failed": true}, bson.M{"lockedUntil": bson.M{"$lte": now}}},
+			},
+			bson.M{"$set": bson.M{"failed": false, "lockedUntil": now.Add(UsageBatchLease)}},
+		)
+
+		if err != nil {
+			return false, err
 		}
 
-		return nil, err
+		return result.ModifiedCount > 0, nil
 	}
 
-	var result User
+	return err == nil, err
+}
 
-	if err := cur.Decode(&result); err != nil {
-		return nil, err
+func (c *MongoDB) InsertWebhook(document Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionWebhooks).InsertOne(ctx, document)
+
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateKey
 	}
 
-	return &result, nil
+	return err
 }
 
-func (c *MongoDB) GetUserByID(id string) (*User, error) {
+func (c *MongoDB) InsertWebhookDeliveries(documents []WebhookDelivery) error {
+	if len(documents) < 1 {
+		return nil
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 	defer cancel()
 
-	cur := c.Database.Collection(CollectionUsers).FindOne(ctx, bson.M{"_id": id})
+	values := make([]interface{}, 0, len(documents))
 
-	if err := cur.Err(); err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, nil
+	for _, document := range documents {
+		values = append(values, document)
+	}
+
+	_, err := c.Database.Collection(CollectionDeliveries).InsertMany(ctx, values)
+
+	return err
+}
+
+func (c *MongoDB) InsertAlert(id, application string, expiresAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionAlerts).InsertOne(ctx, bson.M{
+		"_id":         id,
+		"application": application,
+		"createdAt":   time.Now().UTC(),
+		"expiresAt":   expiresAt,
+	})
+
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (c *MongoDB) IncrementUsage(batchID string, increments []*UsageIncrement) error {
+	if len(increments) < 1 {
+		return nil
+	}
+
+	var (
+		requestLogModels  = make([]mongo.WriteModel, 0, len(increments))
+		tokenModels       = make([]mongo.WriteModel, 0)
+		applicationModels = make([]mongo.WriteModel, 0)
+		tokenCounts       = make(map[string]int64)
+		tokenLastUsedAt   = make(map[string]time.Time)
+		applicationCounts = make(map[string]int64)
+	)
+
+	for _, increment := range increments {
+		requestLogModels = append(
+			requestLogModels,
+			mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"application": increment.Application, "token": increment.Token, "timestamp": increment.Timestamp, "appliedBatches": bson.M{"$ne": batchID}}).
+				SetUpdate(bson.M{
+					"$inc":         bson.M{"requestCount": increment.RequestCount},
+					"$push":        appliedBatch(batchID),
+					"$setOnInsert": bson.M{"_id": RandomHexString(12)},
+				}).
+				SetUpsert(true),
+		)
+
+		tokenCounts[increment.Token] += increment.RequestCount
+		applicationCounts[increment.Application] += increment.RequestCount
+
+		if increment.LastUsedAt.After(tokenLastUsedAt[increment.Token]) {
+			tokenLastUsedAt[increment.Token] = increment.LastUsedAt
 		}
+	}
 
-		return nil, err
+	for token, count := range tokenCounts {
+		tokenModels = append(
+			tokenModels,
+			mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": token, "appliedBatches": bson.M{"$ne": batchID}}).
+				SetUpdate(bson.M{
+					"$inc":  bson.M{"requestCount": count},
+					"$max":  bson.M{"lastUsedAt": tokenLastUsedAt[token]},
+					"$push": appliedBatch(batchID),
+				}),
+		)
 	}
 
-	var result User
+	for application, count := range applicationCounts {
+		applicationModels = append(
+			applicationModels,
+			mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": application, "appliedBatches": bson.M{"$ne": batchID}}).
+				SetUpdate(bson.M{
+					"$inc":  bson.M{"requestCount": count},
+					"$push": appliedBatch(batchID),
+				}),
+		)
+	}
 
-	if err := cur.Decode(&result); err != nil {
-		return nil, err
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+
+	defer cancel()
+
+	batches := c.Database.Collection(CollectionUsageBatches)
+
+	var batch struct {
+		Stages []string `bson:"stages"`
 	}
 
-	return &result, nil
+	if err := batches.FindOne(ctx, bson.M{"_id": batchID}).Decode(&batch); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	stages := make([]usageStage, 0, 3)
+
+	for _, stage := range []usageStage{
+		{Name: "requestLog", Collection: CollectionRequestLog, Models: requestLogModels},
+		{Name: "tokens", Collection: CollectionTokens, Models: tokenModels},
+		{Name: "applications", Collection: CollectionApplications, Models: applicationModels},
+	} {
+		if !ContainsString(batch.Stages, stage.Name) {
+			stages = append(stages, stage)
+		}
+	}
+
+	var err error
+
+	if c.Transactions {
+		err = c.applyUsageStagesInTransaction(ctx, batchID, stages)
+	} else {
+		err = c.applyUsageStages(ctx, batchID, stages)
+	}
+
+	if err != nil {
+		if _, markErr := batches.UpdateOne(ctx, bson.M{"_id": batchID}, bson.M{"$set": bson.M{"failed": true}}); markErr != nil {
+			log.Printf("Error: failed to mark usage batch %s as failed: %v\n", batchID, markErr)
+		}
+
+		return fmt.Errorf("%w: %v", ErrUsageBatchIncomplete, err)
+	}
+
+	// Every write has been applied, so failing to mark the batch only means that a retry after its lease runs out
+	// applies nothing.
+	if _, err := batches.UpdateOne(ctx, bson.M{"_id": batchID}, bson.M{"$set": bson.M{"completed": true}}); err != nil {
+		log.Printf("Error: failed to mark usage batch %s as completed: %v\n", batchID, err)
+	}
+
+	return nil
 }
 
-func (c *MongoDB) GetSessionByID(id string) (*Session, error) {
+// appliedBatch returns the $push operation that records the batch on a document it increments, keeping only the
+// most recent batches. The filter of the increment skips documents that already record the batch, so a stage that
+// partly failed can be applied again without counting the same requests twice.
+func appliedBatch(batchID string) bson.M {
+	return bson.M{"appliedBatches": bson.M{"$each": bson.A{batchID}, "$slice": -UsageBatchHistory}}
+}
+
+// usageStage is one of the bulk writes applying a usage batch, whose name is recorded on the batch once it
+// has been applied.
+type usageStage struct {
+	Name       string
+	Collection string
+	Models     []mongo.WriteModel
+}
+
+// applyUsageStagesInTransaction applies every stage at once, so a failed batch has none of its stages applied.
+func (c *MongoDB) applyUsageStagesInTransaction(ctx context.Context, batchID string, stages []usageStage) error {
+	session, err := c.Client.StartSession()
+
+	if err != nil {
+		return err
+	}
+
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, c.applyUsageStages(sc, batchID, stages)
+	})
+
+	return err
+}
+
+// applyUsageStages applies the stages one at a time, recording each on the batch after it succeeds so that a
+// retry of the batch does not apply it again.
+func (c *MongoDB) applyUsageStages(ctx context.Context, batchID string, stages []usageStage) error {
+	for _, stage := range stages {
+		if len(stage.Models) > 0 {
+			_, err := c.Database.Collection(stage.Collection).BulkWrite(ctx, stage.Models, options.BulkWrite().SetOrdered(false))
+
+			if err != nil {
+				if err = c.retryDuplicateUpserts(ctx, stage, err); err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err := c.Database.Collection(CollectionUsageBatches).UpdateOne(ctx, bson.M{"_id": batchID}, bson.M{"$addToSet": bson.M{"stages": stage.Name}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// retryDuplicateUpserts handles a bulk write that only failed because upserts inserted a document that already
+// exists, which happens when the existing document has already recorded the batch or was inserted at the same
+// time by another batch. Those writes are applied again without upserting, which increments the document unless
+// it has already recorded the batch. Any other error is returned as it is.
+func (c *MongoDB) retryDuplicateUpserts(ctx context.Context, stage usageStage, err error) error {
+	var bulkErr mongo.BulkWriteException
+
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) < 1 {
+		return err
+	}
+
+	models := make([]mongo.WriteModel, 0, len(bulkErr.WriteErrors))
+
+	for _, writeErr := range bulkErr.WriteErrors {
+		model, ok := stage.Models[writeErr.Index].(*mongo.UpdateOneModel)
+
+		if !ok || !mongo.IsDuplicateKeyError(writeErr) {
+			return err
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(model.Filter).SetUpdate(model.Update))
+	}
+
+	_, err = c.Database.Collection(stage.Collection).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+
+	return err
+}
+
+func (c *MongoDB) GetUserByEmail(email string) (*User, error) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 	defer cancel()
 
-	cur := c.Database.Collection(CollectionSessions).FindOne(ctx, bson.M{"_id": id})
+	cur := c.Database.Collection(CollectionUsers).FindOne(ctx, bson.M{"email": email})
 
 	if err := cur.Err(); err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
@@ -200,7 +559,7 @@ func (c *MongoDB) GetSessionByID(id string) (*Session, error) {
 		return nil, err
 	}
 
-	var result Session
+	var result User
 
 	if err := cur.Decode(&result); err != nil {
 		return nil, err
@@ -209,13 +568,13 @@ func (c *MongoDB) GetSessionByID(id string) (*Session, error) {
 	return &result, nil
 }
 
-func (c *MongoDB) GetTokenByID(id string) (*Token, error) {
+func (c *MongoDB) GetUserByID(id string) (*User, error) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 	defer cancel()
 
-	cur := c.Database.Collection(CollectionTokens).FindOne(ctx, bson.M{"_id": id})
+	cur := c.Database.Collection(CollectionUsers).FindOne(ctx, bson.M{"_id": id})
 
 	if err := cur.Err(); err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
@@ -225,7 +584,7 @@ func (c *MongoDB) GetTokenByID(id string) (*Token, error) {
 		return nil, err
 	}
 
-	var result Token
+	var result User
 
 	if err := cur.Decode(&result); err != nil {
 		return nil, err
@@ -234,13 +593,13 @@ func (c *MongoDB) GetTokenByID(id string) (*Token, error) {
 	return &result, nil
 }
 
-func (c *MongoDB) GetApplicationByID(id string) (*Application, error) {
+func (c *MongoDB) GetSessionByID(id string) (*Session, error) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 	defer cancel()
 
-	cur := c.Database.Collection(CollectionApplications).FindOne(ctx, bson.M{"_id": id})
+	cur := c.Database.Collection(CollectionSessions).FindOne(ctx, bson.M{"_id": id})
 
 	if err := cur.Err(); err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
@@ -250,7 +609,7 @@ func (c *MongoDB) GetApplicationByID(id string) (*Application, error) {
 		return nil, err
 	}
 
-	var result Application
+	var result Session
 
 	if err := cur.Decode(&result); err != nil {
 		return nil, err
@@ -259,33 +618,14 @@ func (c *MongoDB) GetApplicationByID(id string) (*Application, error) {
 	return &result, nil
 }
 
-func (c *MongoDB) GetApplicationsByUser(user string, sort, direction string) ([]*Application, error) {
-	var sortQuery bson.M
-
-	switch sort {
-	default:
-		fallthrough
-	case "name":
-		{
-			sortQuery = bson.M{"name": GetSortDirectionValue(direction)}
-
-			break
-		}
-	case "createdAt":
-		{
-			sortQuery = bson.M{"createdAt": GetSortDirectionValue(direction)}
-
-			break
-		}
-	}
-
+func (c *MongoDB) GetSessionsByUser(user string) ([]*Session, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 	defer cancel()
 
-	cur, err := c.Database.Collection(CollectionApplications).Aggregate(ctx, []bson.M{
+	cur, err := c.Database.Collection(CollectionSessions).Aggregate(ctx, []bson.M{
 		{"$match": bson.M{"user": user}},
-		{"$sort": sortQuery},
+		{"$sort": bson.M{"lastUsedAt": -1}},
 	})
 
 	if err != nil {
@@ -296,7 +636,7 @@ func (c *MongoDB) GetApplicationsByUser(user string, sort, direction string) ([]
 		return nil, err
 	}
 
-	result := make([]*Application, 0)
+	result := make([]*Session, 0)
 
 	if err := cur.All(ctx, &result); err != nil {
 		return nil, err
@@ -305,105 +645,651 @@ func (c *MongoDB) GetApplicationsByUser(user string, sort, direction string) ([]
 	return result, nil
 }
 
-func (c *MongoDB) GetTokensByApplication(application, sort, direction string) ([]*Token, error) {
-	var sortQuery bson.M
-
-	switch sort {
-	default:
-		fallthrough
-	case "name":
-		{
-			sortQuery = bson.M{"name": GetSortDirectionValue(direction)}
-
-			break
-		}
-	case "createdAt":
-		{
-			sortQuery = bson.M{"createdAt": GetSortDirectionValue(direction)}
-
-			break
-		}
-	case "lastUsedAt":
-		{
-			sortQuery = bson.M{"lastUsedAt": GetSortDirectionValue(direction)}
-
-			break
-		}
-	case "totalRequests":
-		{
-			sortQuery = bson.M{"totalRequests": GetSortDirectionValue(direction)}
-
-			break
-		}
-	}
+func (c *MongoDB) GetTokenByID(id string) (*Token, error) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 	defer cancel()
 
-	cur, err := c.Database.Collection(CollectionTokens).Aggregate(ctx, []bson.M{
-		{"$match": bson.M{"application": application}},
-		{"$sort": sortQuery},
-	})
-
-	if err != nil {
-		return nil, err
-	}
+	cur := c.Database.Collection(CollectionTokens).FindOne(ctx, bson.M{"_id": id})
 
 	if err := cur.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
 		return nil, err
 	}
 
-	result := make([]*Token, 0)
+	var result Token
 
-	if err := cur.All(ctx, &result); err != nil {
+	if err := cur.Decode(&result); err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	return &result, nil
 }
 
-func (c *MongoDB) GetRequestLogsByApplication(application string, from, to time.Time) ([]*RequestLog, error) {
+func (c *MongoDB) GetTokenByHash(hash string) (*Token, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 	defer cancel()
 
-	cur, err := c.Database.Collection(CollectionRequestLog).Aggregate(ctx, []bson.M{
-		{
-			"$match": bson.M{
-				"application": application,
-				"timestamp": bson.M{
-					"$gte": from,
-					"$lt":  to,
-				},
-			},
-		},
-	})
-
-	if err != nil {
-		return nil, err
-	}
+	cur := c.Database.Collection(CollectionTokens).FindOne(ctx, bson.M{"$or": bson.A{bson.M{"hash": hash}, bson.M{"previousSecretHash": hash}}})
 
 	if err := cur.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
 		return nil, err
 	}
 
-	result := make([]*RequestLog, 0)
+	var result Token
 
-	if err := cur.All(ctx, &result); err != nil {
+	if err := cur.Decode(&result); err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	return &result, nil
 }
 
-func (c *MongoDB) UpdateApplicationByID(id string, update bson.M) error {
-
+func (c *MongoDB) GetTokenByApplicationAndID(application, id string) (*Token, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 	defer cancel()
 
-	_, err := c.Database.Collection(CollectionApplications).UpdateOne(ctx, bson.M{"_id": id}, update)
+	cur := c.Database.Collection(CollectionTokens).FindOne(ctx, bson.M{"_id": id, "application": application})
+
+	if err := cur.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var result Token
+
+	if err := cur.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (c *MongoDB) GetApplicationByID(id string) (*Application, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	cur := c.Database.Collection(CollectionApplications).FindOne(ctx, bson.M{"_id": id})
+
+	if err := cur.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var result Application
+
+	if err := cur.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (c *MongoDB) IterateApplications(fn func(*Application) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+
+	defer cancel()
+
+	cur, err := c.Database.Collection(CollectionApplications).Find(ctx, bson.M{})
+
+	if err != nil {
+		return err
+	}
+
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var result Application
+
+		if err := cur.Decode(&result); err != nil {
+			return err
+		}
+
+		if err := fn(&result); err != nil {
+			return err
+		}
+	}
+
+	return cur.Err()
+}
+
+func (c *MongoDB) GetNotificationPreferences(application string) (*NotificationPreferences, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	cur := c.Database.Collection(CollectionPreferences).FindOne(ctx, bson.M{"_id": application})
+
+	if err := cur.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var result NotificationPreferences
+
+	if err := cur.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (c *MongoDB) GetWebhookByID(id string) (*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	cur := c.Database.Collection(CollectionWebhooks).FindOne(ctx, bson.M{"_id": id})
+
+	if err := cur.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var result Webhook
+
+	if err := cur.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (c *MongoDB) GetWebhookByApplicationAndID(application, id string) (*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	cur := c.Database.Collection(CollectionWebhooks).FindOne(ctx, bson.M{"_id": id, "application": application})
+
+	if err := cur.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var result Webhook
+
+	if err := cur.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (c *MongoDB) GetWebhooksByApplication(application string) ([]*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	cur, err := c.Database.Collection(CollectionWebhooks).Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"application": application, "deletedAt": nil}},
+		{"$sort": bson.M{"createdAt": 1}},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]*Webhook, 0)
+
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (c *MongoDB) GetWebhookDeliveriesByWebhook(webhook string, limit int64) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	cur, err := c.Database.Collection(CollectionDeliveries).Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"webhook": webhook}},
+		{"$sort": bson.M{"createdAt": -1}},
+		{"$limit": limit},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]*WebhookDelivery, 0)
+
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (c *MongoDB) ClaimWebhookDelivery(now, lockedUntil time.Time) (*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	cur := c.Database.Collection(CollectionDeliveries).FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"status":        "pending",
+			"nextAttemptAt": bson.M{"$lte": now},
+			"$or": []bson.M{
+				{"lockedUntil": nil},
+				{"lockedUntil": bson.M{"$lte": now}},
+			},
+		},
+		bson.M{"$set": bson.M{"lockedUntil": lockedUntil}},
+		options.FindOneAndUpdate().SetSort(bson.M{"nextAttemptAt": 1}).SetReturnDocument(options.After),
+	)
+
+	if err := cur.Err(); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var result WebhookDelivery
+
+	if err := cur.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (c *MongoDB) GetApplicationsByUser(user string, query *ListQuery) ([]*Application, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	cur, err := c.Database.Collection(CollectionApplications).Aggregate(ctx, listPipeline(bson.M{"user": user, "deletedAt": nil}, query))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]*Application, 0)
+
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (c *MongoDB) GetTokensByApplication(application string, query *ListQuery) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	cur, err := c.Database.Collection(CollectionTokens).Aggregate(ctx, listPipeline(bson.M{"application": application, "deletedAt": nil}, query))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]*Token, 0)
+
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (c *MongoDB) GetRequestLogBuckets(query *UsageQuery) ([]*RequestLogBucket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+
+	defer cancel()
+
+	match := bson.M{
+		"application": query.Application,
+		"timestamp": bson.M{
+			"$gte": query.From,
+			"$lt":  query.To,
+		},
+	}
+
+	if len(query.Token) > 0 {
+		match["token"] = query.Token
+	}
+
+	group := bson.M{
+		"timestamp": bson.M{
+			"$dateTrunc": bson.M{
+				"date":        "$timestamp",
+				"unit":        query.Interval,
+				"timezone":    query.Location.String(),
+				"startOfWeek": "monday",
+			},
+		},
+	}
+
+	if query.GroupByToken {
+		group["token"] = "$token"
+	}
+
+	cur, err := c.Database.Collection(CollectionRequestLog).Aggregate(ctx, []bson.M{
+		{"$match": match},
+		{
+			"$group": bson.M{
+				"_id":          group,
+				"requestCount": bson.M{"$sum": "$requestCount"},
+			},
+		},
+		{
+			"$project": bson.M{
+				"_id":          0,
+				"token":        "$_id.token",
+				"timestamp":    "$_id.timestamp",
+				"requestCount": 1,
+			},
+		},
+		{"$sort": bson.M{"timestamp": 1}},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]*RequestLogBucket, 0)
+
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (c *MongoDB) SumRequestLogs(application string, from, to time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+
+	defer cancel()
+
+	cur, err := c.Database.Collection(CollectionRequestLog).Aggregate(ctx, []bson.M{
+		{
+			"$match": bson.M{
+				"application": application,
+				"timestamp": bson.M{
+					"$gte": from,
+					"$lt":  to,
+				},
+			},
+		},
+		{
+			"$group": bson.M{
+				"_id":          nil,
+				"requestCount": bson.M{"$sum": "$requestCount"},
+			},
+		},
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := cur.Err(); err != nil {
+		return 0, err
+	}
+
+	result := make([]*RequestLogBucket, 0)
+
+	if err := cur.All(ctx, &result); err != nil {
+		return 0, err
+	}
+
+	if len(result) < 1 {
+		return 0, nil
+	}
+
+	return result[0].RequestCount, nil
+}
+
+func (c *MongoDB) IterateRequestLogExport(query *UsageQuery, group string, fn func(*RequestLogBucket) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+
+	defer cancel()
+
+	pipeline := []bson.M{
+		{
+			"$match": bson.M{
+				"application": query.Application,
+				"timestamp": bson.M{
+					"$gte": query.From,
+					"$lt":  query.To,
+				},
+			},
+		},
+	}
+
+	switch group {
+	case "token":
+		pipeline = append(
+			pipeline,
+			bson.M{"$group": bson.M{"_id": "$token", "requestCount": bson.M{"$sum": "$requestCount"}}},
+			bson.M{"$project": bson.M{"_id": 0, "token": "$_id", "requestCount": 1}},
+			bson.M{"$sort": bson.M{"token": 1}},
+		)
+	case "interval":
+		pipeline = append(
+			pipeline,
+			bson.M{
+				"$group": bson.M{
+					"_id": bson.M{
+						"$dateTrunc": bson.M{
+							"date":        "$timestamp",
+							"unit":        query.Interval,
+							"timezone":    query.Location.String(),
+							"startOfWeek": "monday",
+						},
+					},
+					"requestCount": bson.M{"$sum": "$requestCount"},
+				},
+			},
+			bson.M{"$project": bson.M{"_id": 0, "timestamp": "$_id", "requestCount": 1}},
+			bson.M{"$sort": bson.M{"timestamp": 1}},
+		)
+	default:
+		pipeline = append(pipeline, bson.M{"$sort": bson.M{"timestamp": 1, "token": 1}})
+	}
+
+	cur, err := c.Database.Collection(CollectionRequestLog).Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+
+	if err != nil {
+		return err
+	}
+
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var result RequestLogBucket
+
+		if err := cur.Decode(&result); err != nil {
+			return err
+		}
+
+		if err := fn(&result); err != nil {
+			return err
+		}
+	}
+
+	return cur.Err()
+}
+
+func (c *MongoDB) UpsertNotificationPreferences(document NotificationPreferences) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionPreferences).ReplaceOne(ctx, bson.M{"_id": document.Application}, document, options.Replace().SetUpsert(true))
+
+	return err
+}
+
+func (c *MongoDB) UpdateWebhookDeliveryByID(id string, fields Fields) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionDeliveries).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+
+	return err
+}
+
+func (c *MongoDB) UpdateUserByID(id string, fields Fields) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionUsers).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+
+	return err
+}
+
+func (c *MongoDB) UpdateSessionByID(id string, fields Fields) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionSessions).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+
+	return err
+}
+
+func (c *MongoDB) UpdateApplicationByID(id string, fields Fields) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionApplications).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+
+	return err
+}
+
+func (c *MongoDB) UpdateTokenByID(id string, fields Fields) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionTokens).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields})
+
+	return err
+}
+
+func (c *MongoDB) DeleteSessionByID(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionSessions).DeleteOne(ctx, bson.M{"_id": id})
+
+	return err
+}
+
+func (c *MongoDB) DeleteSessionByPublicID(user, publicID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	result, err := c.Database.Collection(CollectionSessions).DeleteOne(ctx, bson.M{"user": user, "publicId": publicID})
+
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+func (c *MongoDB) DeleteSessionsByUser(user, exceptID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	result, err := c.Database.Collection(CollectionSessions).DeleteMany(ctx, bson.M{"user": user, "_id": bson.M{"$ne": exceptID}})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+func (c *MongoDB) DeleteUsageBatch(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionUsageBatches).DeleteOne(ctx, bson.M{"_id": id})
+
+	return err
+}
+
+func (c *MongoDB) DeleteAlert(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionAlerts).DeleteOne(ctx, bson.M{"_id": id})
+
+	return err
+}
+
+func (c *MongoDB) DeleteWebhookByID(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.Database.Collection(CollectionWebhooks).DeleteOne(ctx, bson.M{"_id": id})
 
 	return err
 }
@@ -419,15 +1305,65 @@ func (c *MongoDB) DeleteTokenByID(id string) error {
 	return err
 }
 
-func (c *MongoDB) DeleteApplicationByID(id string) error {
+func (c *MongoDB) DeleteApplication(id string, purgeRequestLog bool) error {
+	return c.deleteCascade(applicationCascade(id, purgeRequestLog))
+}
+
+func (c *MongoDB) DeleteUser(id string, deletedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	// The applications are soft deleted first, so that they can still be found by the purger if deleting the
+	// user fails.
+	if _, err := c.Database.Collection(CollectionApplications).UpdateMany(ctx, bson.M{"user": id, "deletedAt": nil}, bson.M{"$set": bson.M{"deletedAt": deletedAt}}); err != nil {
+		return err
+	}
+
+	return c.deleteCascade([]cascadeStep{
+		{Collection: CollectionSessions, Filter: bson.M{"user": id}},
+		{Collection: CollectionUsers, Filter: bson.M{"_id": id}},
+	})
+}
 
+func (c *MongoDB) GetDeletedApplications(before time.Time) ([]*Application, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 
 	defer cancel()
 
-	_, err := c.Database.Collection(CollectionApplications).DeleteOne(ctx, bson.M{"_id": id})
+	cur, err := c.Database.Collection(CollectionApplications).Find(ctx, bson.M{"deletedAt": bson.M{"$lte": before}})
 
-	return err
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Application, 0)
+
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (c *MongoDB) GetDeletedTokens(before time.Time) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	cur, err := c.Database.Collection(CollectionTokens).Find(ctx, bson.M{"deletedAt": bson.M{"$lte": before}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Token, 0)
+
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
 
 func (c *MongoDB) Close() error {
@@ -437,3 +1373,64 @@ func (c *MongoDB) Close() error {
 
 	return c.Client.Disconnect(ctx)
 }
+
+// listPipeline returns the aggregation stages that filter, sort and limit a list of applications or tokens.
+// MongoDB sorts missing values before every other value, which the cursor condition has to account for.
+func listPipeline(match bson.M, query *ListQuery) []bson.M {
+	if len(query.Search) > 0 {
+		match["name"] = bson.M{"$regex": regexp.QuoteMeta(query.Search), "$options": "i"}
+	}
+
+	if query.CreatedAfter != nil || query.CreatedBefore != nil {
+		createdAt := bson.M{}
+
+		if query.CreatedAfter != nil {
+			createdAt["$gt"] = *query.CreatedAfter
+		}
+
+		if query.CreatedBefore != nil {
+			createdAt["$lt"] = *query.CreatedBefore
+		}
+
+		match["createdAt"] = createdAt
+	}
+
+	if query.Cursor != nil {
+		var (
+			field      = query.Sort
+			value      = query.Cursor.Value
+			comparison = "$gt"
+		)
+
+		if query.Direction == "descending" {
+			comparison = "$lt"
+		}
+
+		switch {
+		case value == nil && comparison == "$gt":
+			match["$or"] = bson.A{bson.M{field: nil, "_id": bson.M{"$gt": query.Cursor.ID}}, bson.M{field: bson.M{"$ne": nil}}}
+		case value == nil:
+			match[field] = nil
+			match["_id"] = bson.M{"$gt": query.Cursor.ID}
+		default:
+			conditions := bson.A{bson.M{field: bson.M{comparison: value}}, bson.M{field: value, "_id": bson.M{"$gt": query.Cursor.ID}}}
+
+			if comparison == "$lt" {
+				conditions = append(conditions, bson.M{field: nil})
+			}
+
+			match["$or"] = conditions
+		}
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$sort": bson.D{{Key: query.Sort, Value: GetSortDirectionValue(query.Direction)}, {Key: "_id", Value: 1}}},
+	}
+
+	if query.Limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": query.Limit})
+	}
+
+	return pipeline
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification is a message sent to the owner of an application.
+type Notification struct {
+	Kind        string    `json:"kind"`
+	Application string    `json:"application"`
+	Token       string    `json:"token,omitempty"`
+	Subject     string    `json:"subject"`
+	Message     string    `json:"message"`
+	Threshold   int       `json:"threshold,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// alerts are the keys recorded to avoid sending the notification again, which are removed if it fails to send.
+	// They are kept until expiresAt, as are the deliveries through each channel.
+	alerts    []string
+	expiresAt time.Time
+}
+
+// Notifier delivers notifications through a single channel. Implementations decide from the preferences
+// whether the notification should be delivered through their channel, and do nothing if not.
+type Notifier interface {
+	Notify(notification *Notification, owner *User, preferences *NotificationPreferences) error
+}
+
+// NewNotifier returns a notifier that delivers through every channel available in the configuration.
+func NewNotifier(store Store, conf AlertsConfig) Notifier {
+	notifiers := &MultiNotifier{
+		Store: store,
+		Channels: map[string]Notifier{
+			"webhook": &WebhookNotifier{
+				Client: NewWebhookClient(config.Webhooks.Timeout),
+			},
+		},
+	}
+
+	if len(conf.SMTP.Host) > 0 {
+		notifiers.Channels["email"] = &SMTPNotifier{
+			Host:     conf.SMTP.Host,
+			Port:     conf.SMTP.Port,
+			Username: conf.SMTP.Username,
+			Password: conf.SMTP.Password,
+			From:     conf.SMTP.From,
+		}
+	}
+
+	return notifiers
+}
+
+// MultiNotifier delivers notifications through several named channels. The delivery through each channel is
+// recorded as an alert, so that a notification that is sent again because another channel failed is only
+// delivered through the channels that have not delivered it yet.
+type MultiNotifier struct {
+	Store    Store
+	Channels map[string]Notifier
+}
+
+// Notify delivers the notification through every channel, returning the first error that occurred.
+func (n *MultiNotifier) Notify(notification *Notification, owner *User, preferences *NotificationPreferences) error {
+	channels := make([]string, 0, len(n.Channels))
+
+	for channel := range n.Channels {
+		channels = append(channels, channel)
+	}
+
+	sort.Strings(channels)
+
+	var result error
+
+	for _, channel := range channels {
+		var key string
+
+		// The alerts of a notification belong to no other notification, so the first one identifies it.
+		if len(notification.alerts) > 0 {
+			key = fmt.Sprintf("%s:%s", notification.alerts[0], channel)
+
+			inserted, err := n.Store.InsertAlert(key, notification.Application, notification.expiresAt)
+
+			if err != nil {
+				if result == nil {
+					result = err
+				}
+
+				continue
+			}
+
+			if !inserted {
+				continue
+			}
+		}
+
+		if err := n.Channels[channel].Notify(notification, owner, preferences); err != nil {
+			if len(key) > 0 {
+				if err := n.Store.DeleteAlert(key); err != nil {
+					log.Printf("Error: failed to release alert %s: %v\n", key, err)
+				}
+			}
+
+			if result == nil {
+				result = fmt.Errorf("%s: %w", channel, err)
+			}
+		}
+	}
+
+	return result
+}
+
+// SMTPNotifier delivers notifications by email to the owner of the application.
+type SMTPNotifier struct {
+	Host     string
+	Port     uint16
+	Username string
+	Password string
+	From     string
+}
+
+// Notify sends the notification by email if the owner has email notifications enabled.
+func (n *SMTPNotifier) Notify(notification *Notification, owner *User, preferences *NotificationPreferences) error {
+	if !preferences.Email || owner == nil || len(owner.Email) < 1 {
+		return nil
+	}
+
+	var auth smtp.Auth
+
+	if len(n.Username) > 0 {
+		auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+	}
+
+	message := strings.Join([]string{
+		fmt.Sprintf("From: %s", n.From),
+		fmt.Sprintf("To: %s", owner.Email),
+		// The subject contains the application name chosen by the user, which is encoded so that it cannot add headers.
+		fmt.Sprintf("Subject: %s", mime.QEncoding.Encode("utf-8", notification.Subject)),
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		notification.Message,
+	}, "\r\n")
+
+	return smtp.SendMail(fmt.Sprintf("%s:%d", n.Host, n.Port), auth, n.From, []string{owner.Email}, []byte(message))
+}
+
+// WebhookNotifier delivers notifications as signed JSON payloads to the webhook URL in the preferences.
+type WebhookNotifier struct {
+	Client *http.Client
+}
+
+// Notify sends the notification to the webhook URL if one is configured.
+func (n *WebhookNotifier) Notify(notification *Notification, owner *User, preferences *NotificationPreferences) error {
+	if len(preferences.WebhookURL) < 1 {
+		return nil
+	}
+
+	body, err := json.Marshal(notification)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", preferences.WebhookURL, bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Mcstatus-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Mcstatus-Signature", fmt.Sprintf("v1=%s", SignWebhookPayload(preferences.WebhookSecret, timestamp, body)))
+
+	resp, err := n.Client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// FakeNotifier records notifications in memory instead of delivering them, for use in tests. If Err is set,
+// every notification fails with it and is not recorded.
+type FakeNotifier struct {
+	Notifications []*Notification
+	Err           error
+	mutex         sync.Mutex
+}
+
+// Notify records the notification.
+func (n *FakeNotifier) Notify(notification *Notification, owner *User, preferences *NotificationPreferences) error {
+	n.mutex.Lock()
+
+	defer n.mutex.Unlock()
+
+	if n.Err != nil {
+		return n.Err
+	}
+
+	n.Notifications = append(n.Notifications, notification)
+
+	return nil
+}
+
+// SignWebhookPayload returns the hex encoded HMAC-SHA256 signature of the timestamp and body, joined by a period.
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	// ApplicationSortKeys are the fields that lists of applications can be sorted by.
+	ApplicationSortKeys []string = []string{"name", "createdAt", "requestCount"}
+	// TokenSortKeys are the fields that lists of tokens can be sorted by.
+	TokenSortKeys []string = []string{"name", "createdAt", "lastUsedAt", "requestCount"}
+	// ListDefaultLimit is the number of items in a page when no limit is given.
+	ListDefaultLimit int64 = 50
+	// ListMaxLimit is the largest number of items that can be requested in a single page.
+	ListMaxLimit int64 = 100
+)
+
+// ListQuery selects the applications or tokens to list and how to sort them. Items are always sorted by
+// their ID after the sort key, which keeps the order stable between pages. A zero limit returns every item.
+type ListQuery struct {
+	Sort          string
+	Direction     string
+	Limit         int64
+	Cursor        *ListCursor
+	Search        string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+}
+
+// ListCursor is the position of the last item of the previous page, by its sort value and ID. The value is
+// a string, a time, an unsigned integer or nil depending on the sort key.
+type ListCursor struct {
+	Value interface{}
+	ID    string
+}
+
+type encodedListCursor struct {
+	Sort      string          `json:"s"`
+	Direction string          `json:"d"`
+	Value     json.RawMessage `json:"v"`
+	ID        string          `json:"id"`
+}
+
+// ParseListQuery parses the sort, direction, limit, cursor, q, createdAfter and createdBefore query parameters
+// of a list request. The returned error describes the invalid parameter and is safe to return to the user.
+func ParseListQuery(ctx *fiber.Ctx, sortKeys []string) (*ListQuery, error) {
+	var (
+		err   error
+		query = &ListQuery{
+			Sort:      ctx.Query("sort", "name"),
+			Direction: ctx.Query("direction", "ascending"),
+			Limit:     ListDefaultLimit,
+			Search:    strings.TrimSpace(ctx.Query("q")),
+		}
+	)
+
+	if !isSortKey(query.Sort, sortKeys) {
+		return nil, fmt.Errorf("invalid sort: %s, expected one of %s", query.Sort, strings.Join(sortKeys, ", "))
+	}
+
+	if query.Direction != "ascending" && query.Direction != "descending" {
+		return nil, fmt.Errorf("invalid direction: %s, expected ascending or descending", query.Direction)
+	}
+
+	if value := ctx.Query("limit"); len(value) > 0 {
+		if query.Limit, err = strconv.ParseInt(value, 10, 64); err != nil || query.Limit < 1 || query.Limit > ListMaxLimit {
+			return nil, fmt.Errorf("invalid limit, expected a number between 1 and %d", ListMaxLimit)
+		}
+	}
+
+	if value := ctx.Query("cursor"); len(value) > 0 {
+		if query.Cursor, err = decodeListCursor(value, query.Sort, query.Direction); err != nil {
+			return nil, errors.New("invalid cursor, it may have been created with a different sort or direction")
+		}
+	}
+
+	if query.CreatedAfter, err = parseListTime(ctx.Query("createdAfter")); err != nil {
+		return nil, errors.New("invalid createdAfter value, expected a Unix timestamp in milliseconds")
+	}
+
+	if query.CreatedBefore, err = parseListTime(ctx.Query("createdBefore")); err != nil {
+		return nil, errors.New("invalid createdBefore value, expected a Unix timestamp in milliseconds")
+	}
+
+	return query, nil
+}
+
+// EncodeCursor returns the opaque cursor of the page that follows the item with the sort value and ID.
+func (q *ListQuery) EncodeCursor(value interface{}, id string) (string, error) {
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		return "", err
+	}
+
+	if data, err = json.Marshal(encodedListCursor{Sort: q.Sort, Direction: q.Direction, Value: data, ID: id}); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Matches returns whether the item with the name and creation time passes the search and date filters.
+// It is used by stores that filter items in memory.
+func (q *ListQuery) Matches(name string, createdAt time.Time) bool {
+	if len(q.Search) > 0 && !strings.Contains(strings.ToLower(name), strings.ToLower(q.Search)) {
+		return false
+	}
+
+	if q.CreatedAfter != nil && !createdAt.After(*q.CreatedAfter) {
+		return false
+	}
+
+	return q.CreatedBefore == nil || createdAt.Before(*q.CreatedBefore)
+}
+
+// After returns whether the item with the sort value and ID comes after the cursor in the sort order.
+// It is used by stores that sort items in memory.
+func (q *ListQuery) After(value interface{}, id string) bool {
+	if q.Cursor == nil {
+		return true
+	}
+
+	if result := CompareSortValues(value, q.Cursor.Value) * GetSortDirectionValue(q.Direction); result != 0 {
+		return result > 0
+	}
+
+	return id > q.Cursor.ID
+}
+
+// SortValue returns the value of the field that the applications are sorted by.
+func (a *Application) SortValue(key string) interface{} {
+	switch key {
+	case "createdAt":
+		return a.CreatedAt
+	case "requestCount":
+		return a.RequestCount
+	default:
+		return a.Name
+	}
+}
+
+// SortValue returns the value of the field that the tokens are sorted by.
+func (t *Token) SortValue(key string) interface{} {
+	switch key {
+	case "createdAt":
+		return t.CreatedAt
+	case "lastUsedAt":
+		if t.LastUsedAt == nil {
+			return nil
+		}
+
+		return *t.LastUsedAt
+	case "requestCount":
+		return t.RequestCount
+	default:
+		return t.Name
+	}
+}
+
+// CompareSortValues compares two values returned by SortValue the way MongoDB sorts them, with nil first.
+func CompareSortValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case time.Time:
+		switch b := b.(time.Time); {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+	case uint64:
+		switch b := b.(uint64); {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func decodeListCursor(value, sort, direction string) (*ListCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor encodedListCursor
+
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+
+	if cursor.Sort != sort || cursor.Direction != direction || len(cursor.ID) < 1 {
+		return nil, errors.New("cursor does not match the query")
+	}
+
+	result := &ListCursor{ID: cursor.ID}
+
+	switch sort {
+	case "createdAt", "lastUsedAt":
+		var value *time.Time
+
+		if err := json.Unmarshal(cursor.Value, &value); err != nil {
+			return nil, err
+		}
+
+		if value != nil {
+			result.Value = *value
+		}
+	case "requestCount":
+		var value uint64
+
+		if err := json.Unmarshal(cursor.Value, &value); err != nil {
+			return nil, err
+		}
+
+		result.Value = value
+	default:
+		var value string
+
+		if err := json.Unmarshal(cursor.Value, &value); err != nil {
+			return nil, err
+		}
+
+		result.Value = value
+	}
+
+	if result.Value == nil && sort != "lastUsedAt" {
+		return nil, errors.New("cursor is missing its value")
+	}
+
+	return result, nil
+}
+
+func parseListTime(value string) (*time.Time, error) {
+	if len(value) < 1 {
+		return nil, nil
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return timePointer(time.UnixMilli(parsed).UTC()), nil
+}
+
+func isSortKey(key string, keys []string) bool {
+	return ContainsString(keys, key)
+}
+
+func timePointer(value time.Time) *time.Time {
+	return &value
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrInvalidPasswordHash is returned when a stored password hash cannot be parsed.
+	ErrInvalidPasswordHash = errors.New("invalid password hash")
+	// ErrUnknownPasswordAlgorithm is returned when the configured password hashing algorithm is not supported.
+	ErrUnknownPasswordAlgorithm = errors.New("unknown password hashing algorithm")
+	// ErrInvalidPasswordConfig is returned when the configured cost parameters cannot be used to hash passwords.
+	ErrInvalidPasswordConfig = errors.New("invalid password hashing configuration")
+)
+
+// PasswordHasher creates and verifies encoded password hashes for a single algorithm.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password, including the salt and cost parameters.
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches the encoded hash.
+	Verify(password, encoded string) (bool, error)
+	// Recognizes reports whether the encoded hash was produced by this algorithm.
+	Recognizes(encoded string) bool
+	// NeedsRehash reports whether the encoded hash uses outdated cost parameters.
+	NeedsRehash(encoded string) bool
+}
+
+// NewPasswordHasher returns the password hasher for the algorithm selected in the configuration, or an error if
+// its cost parameters are out of range.
+func NewPasswordHasher(conf PasswordConfig) (PasswordHasher, error) {
+	switch conf.Algorithm {
+	case "argon2id":
+		if conf.Argon2id.Iterations < 1 {
+			return nil, fmt.Errorf("%w: argon2id iterations must be at least 1", ErrInvalidPasswordConfig)
+		}
+
+		if conf.Argon2id.Parallelism < 1 {
+			return nil, fmt.Errorf("%w: argon2id parallelism must be at least 1", ErrInvalidPasswordConfig)
+		}
+
+		// Argon2 needs at least 8 KiB of memory for each lane.
+		if conf.Argon2id.Memory < 8*uint32(conf.Argon2id.Parallelism) {
+			return nil, fmt.Errorf("%w: argon2id memory must be at least %d KiB with a parallelism of %d", ErrInvalidPasswordConfig, 8*uint32(conf.Argon2id.Parallelism), conf.Argon2id.Parallelism)
+		}
+
+		return &Argon2idHasher{
+			Memory:      conf.Argon2id.Memory,
+			Iterations:  conf.Argon2id.Iterations,
+			Parallelism: conf.Argon2id.Parallelism,
+			SaltLength:  16,
+			KeyLength:   32,
+		}, nil
+	case "bcrypt":
+		if conf.Bcrypt.Cost < bcrypt.MinCost || conf.Bcrypt.Cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("%w: bcrypt cost must be between %d and %d", ErrInvalidPasswordConfig, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+
+		return &BcryptHasher{Cost: conf.Bcrypt.Cost}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownPasswordAlgorithm, conf.Algorithm)
+	}
+}
+
+// Argon2idHasher hashes passwords using Argon2id, encoded in the PHC string format.
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// Hash returns the Argon2id hash of the password using a random salt.
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Memory,
+		h.Iterations,
+		h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify reports whether the password matches the Argon2id hash, comparing in constant time.
+func (h *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	params, err := h.decode(encoded)
+
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(password), params.salt, params.iterations, params.memory, params.parallelism, uint32(len(params.key)))
+
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+// Recognizes reports whether the encoded hash is an Argon2id hash.
+func (h *Argon2idHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+// NeedsRehash reports whether the hash was created with different parameters than the current ones.
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, err := h.decode(encoded)
+
+	if err != nil {
+		return true
+	}
+
+	return params.memory != h.Memory || params.iterations != h.Iterations || params.parallelism != h.Parallelism || uint32(len(params.key)) != h.KeyLength
+}
+
+func (h *Argon2idHasher) decode(encoded string) (*argon2idParams, error) {
+	parts := strings.Split(encoded, "$")
+
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	var version int
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	var params argon2idParams
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	// Argon2 panics rather than returning an error for these parameters.
+	if params.iterations < 1 || params.parallelism < 1 {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+
+	if err != nil {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+
+	if err != nil || len(key) < 1 {
+		return nil, ErrInvalidPasswordHash
+	}
+
+	params.salt = salt
+	params.key = key
+
+	return &params, nil
+}
+
+// BcryptHasher hashes passwords using bcrypt.
+type BcryptHasher struct {
+	Cost int
+}
+
+// Hash returns the bcrypt hash of the password.
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// Verify reports whether the password matches the bcrypt hash.
+func (h *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Recognizes reports whether the encoded hash is a bcrypt hash.
+func (h *BcryptHasher) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// NeedsRehash reports whether the hash was created with a different cost than the current one.
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+
+	return err != nil || cost != h.Cost
+}
+
+// HashPassword returns the encoded hash of the password using the configured algorithm.
+func HashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// VerifyPassword reports whether the password matches the stored hash, and whether the stored hash
+// should be replaced with a new one from HashPassword. Hashes from every supported algorithm are
+// accepted, including unsalted SHA-256 hashes created before passwords were hashed with a KDF.
+func VerifyPassword(password, encoded string) (bool, bool, error) {
+	if isLegacyPasswordHash(encoded) {
+		hash := sha256.Sum256([]byte(password))
+
+		ok := subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(encoded)) == 1
+
+		return ok, ok, nil
+	}
+
+	if passwordHasher.Recognizes(encoded) {
+		ok, err := passwordHasher.Verify(password, encoded)
+
+		return ok, ok && passwordHasher.NeedsRehash(encoded), err
+	}
+
+	for _, hasher := range []PasswordHasher{&Argon2idHasher{}, &BcryptHasher{}} {
+		if !hasher.Recognizes(encoded) {
+			continue
+		}
+
+		ok, err := hasher.Verify(password, encoded)
+
+		return ok, ok, err
+	}
+
+	return false, false, ErrInvalidPasswordHash
+}
+
+// RehashUserPassword replaces the stored password hash of the user with one using the configured algorithm.
+func RehashUserPassword(store Store, user *User, password string) error {
+	hash, err := HashPassword(password)
+
+	if err != nil {
+		return err
+	}
+
+	if err := store.UpdateUserByID(user.ID, Fields{"password": hash}); err != nil {
+		return err
+	}
+
+	user.Password = hash
+
+	return nil
+}
+
+func isLegacyPasswordHash(encoded string) bool {
+	if len(encoded) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(encoded)
+
+	return err == nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewPasswordHasher(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  PasswordConfig
+		valid bool
+	}{
+		{"default", DefaultConfig.Password, true},
+		{"argon2id", PasswordConfig{Algorithm: "argon2id", Argon2id: Argon2idConfig{Memory: 16, Iterations: 1, Parallelism: 2}}, true},
+		{"argon2id without iterations", PasswordConfig{Algorithm: "argon2id", Argon2id: Argon2idConfig{Memory: 64 * 1024, Parallelism: 2}}, false},
+		{"argon2id without parallelism", PasswordConfig{Algorithm: "argon2id", Argon2id: Argon2idConfig{Memory: 64 * 1024, Iterations: 3}}, false},
+		{"argon2id with too little memory", PasswordConfig{Algorithm: "argon2id", Argon2id: Argon2idConfig{Memory: 15, Iterations: 3, Parallelism: 2}}, false},
+		{"bcrypt", PasswordConfig{Algorithm: "bcrypt", Bcrypt: BcryptConfig{Cost: 10}}, true},
+		{"bcrypt with too low a cost", PasswordConfig{Algorithm: "bcrypt", Bcrypt: BcryptConfig{Cost: 3}}, false},
+		{"bcrypt with too high a cost", PasswordConfig{Algorithm: "bcrypt", Bcrypt: BcryptConfig{Cost: 32}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewPasswordHasher(test.conf)
+
+			if test.valid && err != nil {
+				t.Fatalf("expected the configuration to be valid, got %v", err)
+			}
+
+			if !test.valid && !errors.Is(err, ErrInvalidPasswordConfig) {
+				t.Fatalf("expected ErrInvalidPasswordConfig, got %v", err)
+			}
+		})
+	}
+
+	if _, err := NewPasswordHasher(PasswordConfig{Algorithm: "md5"}); !errors.Is(err, ErrUnknownPasswordAlgorithm) {
+		t.Fatalf("expected ErrUnknownPasswordAlgorithm, got %v", err)
+	}
+}
+
+func TestArgon2idHasherRejectsZeroParameters(t *testing.T) {
+	hasher := &Argon2idHasher{Memory: 16, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+	for _, encoded := range []string{
+		"$argon2id$v=19$m=16,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+		"$argon2id$v=19$m=16,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U",
+	} {
+		if _, err := hasher.Verify("password", encoded); !errors.Is(err, ErrInvalidPasswordHash) {
+			t.Fatalf("expected ErrInvalidPasswordHash for %s, got %v", encoded, err)
+		}
+	}
+}
+
+func TestPasswordHasherRoundTrip(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		"argon2id": &Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		"bcrypt":   &BcryptHasher{Cost: 4},
+	}
+
+	for name, hasher := range hashers {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := hasher.Hash("correct horse")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !hasher.Recognizes(encoded) {
+				t.Fatalf("expected the hasher to recognize its own hash %s", encoded)
+			}
+
+			if hasher.NeedsRehash(encoded) {
+				t.Fatalf("expected a fresh hash not to need rehashing: %s", encoded)
+			}
+
+			if ok, err := hasher.Verify("correct horse", encoded); err != nil || !ok {
+				t.Fatalf("expected the password to match, got %v, %v", ok, err)
+			}
+
+			if ok, err := hasher.Verify("battery staple", encoded); err != nil || ok {
+				t.Fatalf("expected a different password not to match, got %v, %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestVerifyLegacyPassword(t *testing.T) {
+	passwordHasher = &BcryptHasher{Cost: 4}
+
+	hash := sha256.Sum256([]byte("password"))
+	encoded := hex.EncodeToString(hash[:])
+
+	if ok, needsRehash, err := VerifyPassword("password", encoded); err != nil || !ok || !needsRehash {
+		t.Fatalf("expected the legacy hash to match and need rehashing, got %v, %v, %v", ok, needsRehash, err)
+	}
+
+	if ok, needsRehash, err := VerifyPassword("wrong password", encoded); err != nil || ok || needsRehash {
+		t.Fatalf("expected a wrong password not to match the legacy hash, got %v, %v, %v", ok, needsRehash, err)
+	}
+}
+
+func TestLoginRehashesLegacyPassword(t *testing.T) {
+	app, store := newTestApp(t)
+
+	hash := sha256.Sum256([]byte("password"))
+
+	if err := store.InsertUser(User{ID: "user", Email: "user@example.com", Password: hex.EncodeToString(hash[:]), Type: "local", CreatedAt: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, data := doRequest(t, app, http.MethodPost, "/auth/login", "", PostLoginRequestBody{Email: "user@example.com", Password: "wrong password"}); status != http.StatusForbidden {
+		t.Fatalf("expected %d for a wrong password, got %d: %s", http.StatusForbidden, status, data)
+	}
+
+	if status, data := doRequest(t, app, http.MethodPost, "/auth/login", "", PostLoginRequestBody{Email: "user@example.com", Password: "password"}); status != http.StatusOK {
+		t.Fatalf("expected %d for the correct password, got %d: %s", http.StatusOK, status, data)
+	}
+
+	user, err := store.GetUserByID("user")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !passwordHasher.Recognizes(user.Password) {
+		t.Fatalf("expected the legacy hash to be replaced with a bcrypt hash, got %s", user.Password)
+	}
+
+	if status, data := doRequest(t, app, http.MethodPost, "/auth/login", "", PostLoginRequestBody{Email: "user@example.com", Password: "password"}); status != http.StatusOK {
+		t.Fatalf("expected %d when logging in with the upgraded hash, got %d: %s", http.StatusOK, status, data)
+	}
+}
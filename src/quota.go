@@ -0,0 +1,184 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	quotaCache *QuotaCache = NewQuotaCache()
+)
+
+// Quota is the request allowance of an application for the current billing period.
+type Quota struct {
+	Plan           string    `json:"plan"`
+	Limit          *uint64   `json:"limit"`
+	Used           int64     `json:"used"`
+	Remaining      *int64    `json:"remaining"`
+	BurstPerSecond uint32    `json:"burstPerSecond"`
+	OverQuota      bool      `json:"overQuota"`
+	PeriodStart    time.Time `json:"periodStart"`
+	ResetsAt       time.Time `json:"resetsAt"`
+}
+
+// GetPlan returns the name and limits of the plan assigned to the application, falling back to the default plan.
+func (a *Application) GetPlan() (string, PlanConfig) {
+	if plan, ok := config.Plans[a.Plan]; ok && len(a.Plan) > 0 {
+		return a.Plan, plan
+	}
+
+	return config.DefaultPlan, config.Plans[config.DefaultPlan]
+}
+
+// GetQuotaPeriod returns the start and end of the monthly billing period containing the time.
+func GetQuotaPeriod(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	return start, start.AddDate(0, 1, 0)
+}
+
+// QuotaCache is an in-process cache of the consumption of applications in the current billing period, so that
+// token introspection does not aggregate the request log on every introspection cache miss.
+type QuotaCache struct {
+	entries   map[string]quotaCacheEntry
+	lastSweep time.Time
+	mutex     *sync.Mutex
+}
+
+type quotaCacheEntry struct {
+	used        int64
+	periodStart time.Time
+	expiresAt   time.Time
+}
+
+// NewQuotaCache creates a new empty quota cache.
+func NewQuotaCache() *QuotaCache {
+	return &QuotaCache{
+		entries:   make(map[string]quotaCacheEntry),
+		lastSweep: time.Now(),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// Get returns the cached consumption of the application in the billing period, if it exists and has not expired.
+func (c *QuotaCache) Get(application string, periodStart time.Time) (int64, bool) {
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[application]
+
+	if !ok {
+		return 0, false
+	}
+
+	if !entry.periodStart.Equal(periodStart) || time.Now().After(entry.expiresAt) {
+		delete(c.entries, application)
+
+		return 0, false
+	}
+
+	return entry.used, true
+}
+
+// Set caches the consumption of the application in the billing period for the quota cache duration.
+func (c *QuotaCache) Set(application string, periodStart time.Time, used int64) {
+	ttl := config.Internal.QuotaCacheTTL
+
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	if now.Sub(c.lastSweep) >= time.Minute {
+		for key, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+
+		c.lastSweep = now
+	}
+
+	c.entries[application] = quotaCacheEntry{
+		used:        used,
+		periodStart: periodStart,
+		expiresAt:   now.Add(ttl),
+	}
+}
+
+// Invalidate removes the cached consumption of the application.
+func (c *QuotaCache) Invalidate(application string) {
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	delete(c.entries, application)
+}
+
+// GetApplicationQuota calculates the consumption of the application in the current billing period from the request log.
+func GetApplicationQuota(store Store, application *Application) (*Quota, error) {
+	periodStart, resetAt := GetQuotaPeriod(time.Now())
+
+	used, err := store.SumRequestLogs(application.ID, periodStart, resetAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newQuota(application, used, periodStart, resetAt), nil
+}
+
+// GetCachedApplicationQuota is like GetApplicationQuota, but reuses the consumption of the application from the quota
+// cache when it is recent enough. The plan and its limits are always read from the application.
+func GetCachedApplicationQuota(store Store, application *Application) (*Quota, error) {
+	periodStart, resetAt := GetQuotaPeriod(time.Now())
+
+	if used, ok := quotaCache.Get(application.ID, periodStart); ok {
+		return newQuota(application, used, periodStart, resetAt), nil
+	}
+
+	used, err := store.SumRequestLogs(application.ID, periodStart, resetAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	quotaCache.Set(application.ID, periodStart, used)
+
+	return newQuota(application, used, periodStart, resetAt), nil
+}
+
+func newQuota(application *Application, used int64, periodStart, resetAt time.Time) *Quota {
+	planName, plan := application.GetPlan()
+
+	result := &Quota{
+		Plan:           planName,
+		Used:           used,
+		BurstPerSecond: plan.BurstPerSecond,
+		PeriodStart:    periodStart,
+		ResetsAt:       resetAt,
+	}
+
+	if plan.MonthlyRequests > 0 {
+		limit := plan.MonthlyRequests
+		remaining := int64(limit) - used
+
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		result.Limit = &limit
+		result.Remaining = &remaining
+		result.OverQuota = used >= int64(limit)
+	}
+
+	return result
+}
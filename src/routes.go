@@ -1,20 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
-	"go.mongodb.org/mongo-driver/bson"
-)
-
-var (
-	UsageChartInterval time.Duration = time.Hour
 )
 
 type PostLoginRequestBody struct {
@@ -39,23 +36,133 @@ type PostApplicationRequestBody struct {
 }
 
 type PostApplicationTokensRequestBody struct {
-	Name string `json:"name" validate:"min=2,max=64,required"`
+	Name             string   `json:"name" validate:"min=2,max=64,required"`
+	ExpiresAt        *int64   `json:"expiresAt"`
+	TTL              *int64   `json:"ttl"`
+	Scopes           []string `json:"scopes" validate:"omitempty,dive,required"`
+	AllowedCIDRs     []string `json:"allowedCidrs" validate:"max=64,dive,required,max=64"`
+	AllowedReferrers []string `json:"allowedReferrers" validate:"max=64,dive,required,max=2048"`
+}
+
+type PostApplicationsResponseBody struct {
+	*Application
+	Secret string `json:"token"`
+}
+
+type PatchApplicationTokenRequestBody struct {
+	Name             *string  `json:"name" validate:"omitempty,min=2,max=64"`
+	ExpiresAt        *int64   `json:"expiresAt"`
+	TTL              *int64   `json:"ttl"`
+	Scopes           []string `json:"scopes" validate:"omitempty,dive,required"`
+	AllowedCIDRs     []string `json:"allowedCidrs" validate:"max=64,dive,required,max=64"`
+	AllowedReferrers []string `json:"allowedReferrers" validate:"max=64,dive,required,max=2048"`
+	Disabled         *bool    `json:"disabled"`
+}
+
+type PostApplicationTokensResponseBody struct {
+	*Token
+	Secret string `json:"token"`
+}
+
+type TokenResponseBody struct {
+	*Token
+	Expired bool `json:"expired"`
+}
+
+type PublicApplicationResponseBody struct {
+	ID               string    `json:"id"`
+	Name             string    `json:"name"`
+	ShortDescription string    `json:"shortDescription"`
+	User             string    `json:"user"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+type PostApplicationNotificationsRequestBody struct {
+	Email       bool   `json:"email"`
+	WebhookURL  string `json:"webhookUrl" validate:"omitempty,http_url,max=2048"`
+	QuotaAlerts bool   `json:"quotaAlerts"`
+	SpikeAlerts bool   `json:"spikeAlerts"`
 }
 
-type UsageLogResponseBody struct {
-	Timestamp    string `json:"timestamp"`
-	RequestCount int64  `json:"requestCount"`
+type PostApplicationWebhooksRequestBody struct {
+	URL    string   `json:"url" validate:"required,http_url,max=2048"`
+	Events []string `json:"events" validate:"required,min=1,dive,required"`
 }
 
-func init() {
+type PostApplicationWebhooksResponseBody struct {
+	*Webhook
+	Secret string `json:"secret"`
+}
+
+type PostInternalTokenIntrospectRequestBody struct {
+	Token   string `json:"token" validate:"required"`
+	IP      string `json:"ip"`
+	Referer string `json:"referer"`
+}
+
+type PostInternalTokenIntrospectResponseBody struct {
+	*TokenIntrospection
+	Allowed      bool   `json:"allowed"`
+	DeniedReason string `json:"deniedReason,omitempty"`
+}
+
+type PostInternalUsageRequestBody struct {
+	BatchID string       `json:"batchId" validate:"required,max=128"`
+	Events  []UsageEvent `json:"events" validate:"required,max=10000,dive"`
+}
+
+type SessionResponseBody struct {
+	ID         string     `json:"id"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"userAgent"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt time.Time  `json:"lastUsedAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	Current    bool       `json:"current"`
+}
+
+type ListResponseBody struct {
+	Items      interface{} `json:"items"`
+	NextCursor *string     `json:"nextCursor"`
+}
+
+// NewApp creates the HTTP server with every route registered, serving requests from the store.
+func NewApp(store Store) *fiber.App {
+	fiberConfig := fiber.Config{
+		DisableStartupMessage: true,
+		ErrorHandler: func(ctx *fiber.Ctx, err error) error {
+			var fiberError *fiber.Error
+
+			if errors.As(err, &fiberError) {
+				return ctx.SendStatus(fiberError.Code)
+			}
+
+			log.Printf("Error: %v - URI: %s\n", err, ctx.Request().URI())
+
+			return ctx.SendStatus(http.StatusInternalServerError)
+		},
+	}
+
+	// The client IP address is only read from the proxy header of requests sent by a trusted proxy.
+	if len(config.Proxy.TrustedProxies) > 0 {
+		fiberConfig.EnableTrustedProxyCheck = true
+		fiberConfig.TrustedProxies = config.Proxy.TrustedProxies
+		fiberConfig.ProxyHeader = config.Proxy.Header
+		fiberConfig.EnableIPValidation = true
+	}
+
+	app := fiber.New(fiberConfig)
+
 	app.Use(recover.New(recover.Config{
 		EnableStackTrace: true,
 	}))
 
+	app.Use(StoreMiddleware(store))
+
 	if config.Environment == "development" {
 		app.Use(cors.New(cors.Config{
 			AllowOrigins:  "*",
-			AllowMethods:  "HEAD,OPTIONS,GET,POST",
+			AllowMethods:  "HEAD,OPTIONS,GET,POST,PATCH,DELETE",
 			ExposeHeaders: "X-Cache-Hit,X-Cache-Time-Remaining",
 		}))
 
@@ -70,16 +177,38 @@ func init() {
 	app.Post("/auth/signup", PostSignupHandler)
 	app.Post("/auth/discord", PostDiscordCallbackHandler)
 	app.Post("/auth/github", PostGitHubCallbackHandler)
+	app.Post("/auth/logout", AuthenticateMiddleware(), RequireAuthMiddleware(), PostLogoutHandler)
 	app.Get("/users/:userID", AuthenticateMiddleware(), GetUserMiddleware("userID"), UserAuthMiddleware(), GetUserHandler)
+	app.Delete("/users/:userID", AuthenticateMiddleware(), GetUserMiddleware("userID"), UserAuthMiddleware(), DeleteUserHandler)
+	app.Get("/users/:userID/sessions", AuthenticateMiddleware(), GetUserMiddleware("userID"), UserAuthMiddleware(), GetUserSessionsHandler)
+	app.Delete("/users/:userID/sessions", AuthenticateMiddleware(), GetUserMiddleware("userID"), UserAuthMiddleware(), DeleteUserSessionsHandler)
+	app.Delete("/users/:userID/sessions/:sessionID", AuthenticateMiddleware(), GetUserMiddleware("userID"), UserAuthMiddleware(), DeleteUserSessionHandler)
 	app.Get("/users/:userID/applications", AuthenticateMiddleware(), GetUserMiddleware("userID"), UserAuthMiddleware(), GetUserApplicationsHandler)
 	app.Post("/applications", AuthenticateMiddleware(), RequireAuthMiddleware(), PostApplicationsHandler)
-	app.Get("/applications/:applicationID", GetApplicationMiddleware("applicationID"), GetApplicationHandler)
-	app.Post("/applications/:applicationID", GetApplicationMiddleware("applicationID"), PostApplicationHandler)
-	app.Delete("/applications/:applicationID", GetApplicationMiddleware("applicationID"), DeleteApplicationHandler)
+	app.Get("/applications/:applicationID", OptionalAuthenticateMiddleware(), GetApplicationMiddleware("applicationID"), GetApplicationHandler)
+	app.Post("/applications/:applicationID", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), PostApplicationHandler)
+	app.Delete("/applications/:applicationID", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), DeleteApplicationHandler)
+	app.Post("/applications/:applicationID/restore", AuthenticateMiddleware(), RequireAuthMiddleware(), GetDeletedApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), PostApplicationRestoreHandler)
 	app.Get("/applications/:applicationID/tokens", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), GetApplicationTokensHandler)
 	app.Post("/applications/:applicationID/tokens", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), PostApplicationTokensHandler)
-	app.Delete("/applications/:applicationID/tokens/:tokenID", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), DeleteApplicationTokenHandler)
-	app.Get("/applications/:applicationID/usage", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), GetApplicationUsageHandler)
+	app.Delete("/applications/:applicationID/tokens/:tokenID", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), GetTokenMiddleware("tokenID"), DeleteApplicationTokenHandler)
+	app.Patch("/applications/:applicationID/tokens/:tokenID", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), GetTokenMiddleware("tokenID"), PatchApplicationTokenHandler)
+	app.Post("/applications/:applicationID/tokens/:tokenID/restore", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), GetDeletedTokenMiddleware("tokenID"), PostApplicationTokenRestoreHandler)
+	app.Post("/applications/:applicationID/tokens/:tokenID/rotate", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), GetTokenMiddleware("tokenID"), PostApplicationTokenRotateHandler)
+	app.Get("/applications/:applicationID/webhooks", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), GetApplicationWebhooksHandler)
+	app.Post("/applications/:applicationID/webhooks", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), PostApplicationWebhooksHandler)
+	app.Delete("/applications/:applicationID/webhooks/:webhookID", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), GetWebhookMiddleware("webhookID"), DeleteApplicationWebhookHandler)
+	app.Get("/applications/:applicationID/webhooks/:webhookID/deliveries", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), GetWebhookMiddleware("webhookID"), GetApplicationWebhookDeliveriesHandler)
+	app.Get("/applications/:applicationID/notifications", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), GetApplicationNotificationsHandler)
+	app.Post("/applications/:applicationID/notifications", AuthenticateMiddleware(), RequireAuthMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationAuthMiddleware(), PostApplicationNotificationsHandler)
+	app.Get("/applications/:applicationID/quota", AuthenticateMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationScopeMiddleware("usage:read"), GetApplicationQuotaHandler)
+	app.Get("/applications/:applicationID/usage", AuthenticateMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationScopeMiddleware("usage:read"), GetApplicationUsageHandler)
+	app.Get("/applications/:applicationID/usage/export", AuthenticateMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationScopeMiddleware("usage:read"), GetApplicationUsageExportHandler)
+	app.Get("/applications/:applicationID/tokens/:tokenID/usage", AuthenticateMiddleware(), GetApplicationMiddleware("applicationID"), ApplicationScopeMiddleware("usage:read"), GetTokenMiddleware("tokenID"), GetApplicationTokenUsageHandler)
+	app.Post("/internal/tokens/introspect", InternalAuthMiddleware(), PostInternalTokenIntrospectHandler)
+	app.Post("/internal/usage", InternalAuthMiddleware(), PostInternalUsageHandler)
+
+	return app
 }
 
 // PingHandler responds with a 200 OK status for simple health checks.
@@ -89,13 +218,15 @@ func PingHandler(ctx *fiber.Ctx) error {
 
 // PostLoginHander authenticates the user with the login information they provide, creating a session.
 func PostLoginHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+
 	var requestBody PostLoginRequestBody
 
 	if err := ctx.BodyParser(&requestBody); err != nil {
 		return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %s", err))
 	}
 
-	user, err := db.GetUserByEmail(requestBody.Email)
+	user, err := store.GetUserByEmail(requestBody.Email)
 
 	if err != nil {
 		return err
@@ -109,17 +240,25 @@ func PostLoginHandler(ctx *fiber.Ctx) error {
 		return ctx.Status(http.StatusForbidden).SendString("A user exists with that email but is not using local login. Please login with the other service provider instead.")
 	}
 
-	if HashPassword(requestBody.Password) != user.Password {
+	valid, needsRehash, err := VerifyPassword(requestBody.Password, user.Password)
+
+	if err != nil {
+		return err
+	}
+
+	if !valid {
 		return ctx.Status(http.StatusForbidden).SendString("Invalid password")
 	}
 
-	sessionDocument := Session{
-		ID:        RandomHexString(16),
-		User:      user.ID,
-		CreatedAt: time.Now(),
+	if needsRehash {
+		if err := RehashUserPassword(store, user, requestBody.Password); err != nil {
+			log.Printf("Failed to rehash password for user %s: %v\n", user.ID, err)
+		}
 	}
 
-	if err := db.InsertSession(sessionDocument); err != nil {
+	sessionDocument := NewSession(user.ID, ctx.IP(), ctx.Get("User-Agent"))
+
+	if err := store.InsertSession(sessionDocument); err != nil {
 		return err
 	}
 
@@ -128,6 +267,8 @@ func PostLoginHandler(ctx *fiber.Ctx) error {
 
 // PostSignupHandler creates a new user with the information, and returns a new session.
 func PostSignupHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+
 	var requestBody PostSignupRequestBody
 
 	if err := ctx.BodyParser(&requestBody); err != nil {
@@ -138,7 +279,7 @@ func PostSignupHandler(ctx *fiber.Ctx) error {
 		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
 	}
 
-	existingUser, err := db.GetUserByEmail(requestBody.Email)
+	existingUser, err := store.GetUserByEmail(requestBody.Email)
 
 	if err != nil {
 		return err
@@ -148,25 +289,32 @@ func PostSignupHandler(ctx *fiber.Ctx) error {
 		return ctx.Status(http.StatusConflict).SendString("A user already exists with that username")
 	}
 
+	passwordHash, err := HashPassword(requestBody.Password)
+
+	if err != nil {
+		return err
+	}
+
 	userDocument := User{
 		ID:        RandomHexString(8),
 		Email:     requestBody.Email,
-		Password:  HashPassword(requestBody.Password),
+		Password:  passwordHash,
 		Type:      "local",
 		CreatedAt: time.Now(),
 	}
 
-	if err := db.InsertUser(userDocument); err != nil {
+	if err := store.InsertUser(userDocument); err != nil {
+		// Another signup with the same email may have been inserted since it was checked above.
+		if errors.Is(err, ErrDuplicateKey) {
+			return ctx.Status(http.StatusConflict).SendString("A user already exists with that username")
+		}
+
 		return err
 	}
 
-	sessionDocument := Session{
-		ID:        RandomHexString(16),
-		User:      userDocument.ID,
-		CreatedAt: time.Now(),
-	}
+	sessionDocument := NewSession(userDocument.ID, ctx.IP(), ctx.Get("User-Agent"))
 
-	if err := db.InsertSession(sessionDocument); err != nil {
+	if err := store.InsertSession(sessionDocument); err != nil {
 		return err
 	}
 
@@ -175,6 +323,8 @@ func PostSignupHandler(ctx *fiber.Ctx) error {
 
 // PostDiscordCallbackHandler authenticates the user using the Discord OAuth code.
 func PostDiscordCallbackHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+
 	code := ctx.Query("code")
 
 	if len(code) < 1 {
@@ -193,7 +343,7 @@ func PostDiscordCallbackHandler(ctx *fiber.Ctx) error {
 		return err
 	}
 
-	user, err := db.GetUserByEmail(discordUser.Email)
+	user, err := store.GetUserByEmail(discordUser.Email)
 
 	if err != nil {
 		return err
@@ -210,7 +360,7 @@ func PostDiscordCallbackHandler(ctx *fiber.Ctx) error {
 			CreatedAt: time.Now().UTC(),
 		}
 
-		if err := db.InsertUser(userDocument); err != nil {
+		if err := store.InsertUser(userDocument); err != nil {
 			return err
 		}
 
@@ -223,13 +373,9 @@ func PostDiscordCallbackHandler(ctx *fiber.Ctx) error {
 		userID = user.ID
 	}
 
-	sessionDocument := Session{
-		ID:        RandomHexString(16),
-		User:      userID,
-		CreatedAt: time.Now(),
-	}
+	sessionDocument := NewSession(userID, ctx.IP(), ctx.Get("User-Agent"))
 
-	if err := db.InsertSession(sessionDocument); err != nil {
+	if err := store.InsertSession(sessionDocument); err != nil {
 		return err
 	}
 
@@ -238,6 +384,8 @@ func PostDiscordCallbackHandler(ctx *fiber.Ctx) error {
 
 // PostGitHubCallbackHandler authenticates the user using the GitHub OAuth code.
 func PostGitHubCallbackHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+
 	code := ctx.Query("code")
 
 	if len(code) < 1 {
@@ -270,7 +418,7 @@ func PostGitHubCallbackHandler(ctx *fiber.Ctx) error {
 		return ctx.Status(http.StatusConflict).SendString("Cannot find a primary email address associated with that GitHub user")
 	}
 
-	user, err := db.GetUserByEmail(primaryEmail)
+	user, err := store.GetUserByEmail(primaryEmail)
 
 	if err != nil {
 		return err
@@ -287,7 +435,7 @@ func PostGitHubCallbackHandler(ctx *fiber.Ctx) error {
 			CreatedAt: time.Now().UTC(),
 		}
 
-		if err := db.InsertUser(userDocument); err != nil {
+		if err := store.InsertUser(userDocument); err != nil {
 			return err
 		}
 
@@ -300,42 +448,153 @@ func PostGitHubCallbackHandler(ctx *fiber.Ctx) error {
 		userID = user.ID
 	}
 
-	sessionDocument := Session{
-		ID:        RandomHexString(16),
-		User:      userID,
-		CreatedAt: time.Now(),
-	}
+	sessionDocument := NewSession(userID, ctx.IP(), ctx.Get("User-Agent"))
 
-	if err := db.InsertSession(sessionDocument); err != nil {
+	if err := store.InsertSession(sessionDocument); err != nil {
 		return err
 	}
 
 	return ctx.JSON(sessionDocument)
 }
 
+// PostLogoutHandler deletes the session used to authenticate the request.
+func PostLogoutHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	session := ctx.Locals("session").(*Session)
+
+	if err := store.DeleteSessionByID(session.ID); err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(http.StatusOK)
+}
+
 // GetUserHandler returns the user by the ID or the current authenticated user.
 func GetUserHandler(ctx *fiber.Ctx) error {
 	return ctx.JSON(ctx.Locals("user"))
 }
 
-// GetUserHandler returns the user by the ID or the current authenticated user.
+// DeleteUserHandler permanently deletes the user along with their sessions and applications.
+func DeleteUserHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	user := ctx.Locals("user").(*User)
+
+	if err := DeleteUser(store, user); err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(http.StatusOK)
+}
+
+// GetUserApplicationsHandler returns a page of the applications owned by the user.
 func GetUserApplicationsHandler(ctx *fiber.Ctx) error {
-	sortBy := ctx.Query("sort", "name")
-	sortDirection := ctx.Query("direction", "ascending")
+	store := ctx.Locals("store").(Store)
+	user := ctx.Locals("user").(*User)
+
+	query, err := ParseListQuery(ctx, ApplicationSortKeys)
+
+	if err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	// One more application than the page holds is requested to find out whether there is a next page.
+	limit := query.Limit
+	query.Limit++
+
+	applications, err := store.GetApplicationsByUser(user.ID, query)
+
+	if err != nil {
+		return err
+	}
+
+	result := ListResponseBody{Items: applications}
+
+	if int64(len(applications)) > limit {
+		last := applications[limit-1]
 
+		cursor, err := query.EncodeCursor(last.SortValue(query.Sort), last.ID)
+
+		if err != nil {
+			return err
+		}
+
+		result.Items = applications[:limit]
+		result.NextCursor = &cursor
+	}
+
+	return ctx.JSON(result)
+}
+
+// GetUserSessionsHandler returns the active sessions of the user.
+func GetUserSessionsHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
 	user := ctx.Locals("user").(*User)
+	currentSession := ctx.Locals("session").(*Session)
 
-	applications, err := db.GetApplicationsByUser(user.ID, sortBy, sortDirection)
+	sessions, err := store.GetSessionsByUser(user.ID)
 
 	if err != nil {
 		return err
 	}
 
-	return ctx.JSON(applications)
+	var (
+		now    = time.Now().UTC()
+		result = make([]*SessionResponseBody, 0)
+	)
+
+	for _, session := range sessions {
+		if session.IsExpired(now) {
+			continue
+		}
+
+		result = append(result, &SessionResponseBody{
+			ID:         session.PublicID,
+			IP:         session.IP,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiryTime(),
+			Current:    session.ID == currentSession.ID,
+		})
+	}
+
+	return ctx.JSON(result)
+}
+
+// DeleteUserSessionHandler revokes a single session of the user.
+func DeleteUserSessionHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	user := ctx.Locals("user").(*User)
+
+	deleted, err := store.DeleteSessionByPublicID(user.ID, ctx.Params("sessionID"))
+
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return ctx.Status(http.StatusNotFound).SendString("No session was found by that ID")
+	}
+
+	return ctx.SendStatus(http.StatusOK)
+}
+
+// DeleteUserSessionsHandler revokes every session of the user except the one used to authenticate the request.
+func DeleteUserSessionsHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	user := ctx.Locals("user").(*User)
+	currentSession := ctx.Locals("session").(*Session)
+
+	if _, err := store.DeleteSessionsByUser(user.ID, currentSession.ID); err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(http.StatusOK)
 }
 
 // PostApplicationsHandler creates a new application using the body data provided.
 func PostApplicationsHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
 	authUser := ctx.Locals("authUser").(*User)
 
 	var requestBody PostApplicationsRequestBody
@@ -344,30 +603,52 @@ func PostApplicationsHandler(ctx *fiber.Ctx) error {
 		return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %s", err))
 	}
 
+	secret, prefix := GenerateAPIToken()
+
 	applicationDocument := Application{
 		ID:               RandomHexString(12),
 		Name:             requestBody.Name,
 		ShortDescription: requestBody.ShortDescription,
 		User:             authUser.ID,
-		Token:            RandomHexString(16),
+		TokenPrefix:      prefix,
+		TokenHash:        HashAPIToken(secret),
+		Plan:             config.DefaultPlan,
 		RequestCount:     0,
 		CreatedAt:        time.Now().UTC(),
 	}
 
-	if err := db.InsertApplication(applicationDocument); err != nil {
+	if err := store.InsertApplication(applicationDocument); err != nil {
 		return err
 	}
 
-	return ctx.Status(http.StatusCreated).JSON(applicationDocument)
+	EmitWebhookEvent(store, applicationDocument.ID, "application.created", &applicationDocument)
+
+	return ctx.Status(http.StatusCreated).JSON(&PostApplicationsResponseBody{
+		Application: &applicationDocument,
+		Secret:      secret,
+	})
 }
 
-// GetApplicationHandler returns the specific application by ID.
+// GetApplicationHandler returns the specific application by ID, omitting private fields unless the owner is authenticated.
 func GetApplicationHandler(ctx *fiber.Ctx) error {
-	return ctx.JSON(ctx.Locals("application").(*Application))
+	application := ctx.Locals("application").(*Application)
+
+	if authUser, ok := ctx.Locals("authUser").(*User); ok && authUser != nil && authUser.ID == application.User {
+		return ctx.JSON(application)
+	}
+
+	return ctx.JSON(&PublicApplicationResponseBody{
+		ID:               application.ID,
+		Name:             application.Name,
+		ShortDescription: application.ShortDescription,
+		User:             application.User,
+		CreatedAt:        application.CreatedAt,
+	})
 }
 
 // PostApplicationHandler updates the details for the application.
 func PostApplicationHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
 	application := ctx.Locals("application").(*Application)
 
 	var requestBody PostApplicationRequestBody
@@ -376,47 +657,102 @@ func PostApplicationHandler(ctx *fiber.Ctx) error {
 		return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %s", err))
 	}
 
-	if err := db.UpdateApplicationByID(application.ID, bson.M{
-		"$set": bson.M{
-			"name":             requestBody.Name,
-			"shortDescription": requestBody.ShortDescription,
-		},
+	if err := store.UpdateApplicationByID(application.ID, Fields{
+		"name":             requestBody.Name,
+		"shortDescription": requestBody.ShortDescription,
 	}); err != nil {
 		return err
 	}
 
+	application.Name = requestBody.Name
+	application.ShortDescription = requestBody.ShortDescription
+
+	EmitWebhookEvent(store, application.ID, "application.updated", application)
+
 	return ctx.SendStatus(http.StatusOK)
 }
 
-// DeleteApplicationHandler permanently deletes the application.
+// DeleteApplicationHandler deletes the application, which can be restored until the grace period has passed.
 func DeleteApplicationHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
 	application := ctx.Locals("application").(*Application)
 
-	if err := db.DeleteApplicationByID(application.ID); err != nil {
+	if err := DeleteApplication(store, application); err != nil {
 		return err
 	}
 
 	return ctx.SendStatus(http.StatusOK)
 }
 
-// GetApplicationTokensHandler returns the tokens listed under the application.
-func GetApplicationTokensHandler(ctx *fiber.Ctx) error {
-	sortBy := ctx.Query("sort", "name")
-	sortDirection := ctx.Query("direction", "ascending")
+// PostApplicationRestoreHandler restores the deleted application if it is within the grace period.
+func PostApplicationRestoreHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	application := ctx.Locals("application").(*Application)
+
+	if !IsRestorable(application.DeletedAt) {
+		return ctx.Status(http.StatusGone).SendString("The application was deleted too long ago to be restored")
+	}
 
+	if err := RestoreApplication(store, application); err != nil {
+		return err
+	}
+
+	return ctx.JSON(application)
+}
+
+// GetApplicationTokensHandler returns a page of the tokens listed under the application.
+func GetApplicationTokensHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
 	application := ctx.Locals("application").(*Application)
 
-	tokens, err := db.GetTokensByApplication(application.ID, sortBy, sortDirection)
+	query, err := ParseListQuery(ctx, TokenSortKeys)
+
+	if err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	// One more token than the page holds is requested to find out whether there is a next page.
+	limit := query.Limit
+	query.Limit++
+
+	tokens, err := store.GetTokensByApplication(application.ID, query)
 
 	if err != nil {
 		return err
 	}
 
-	return ctx.JSON(tokens)
+	var result ListResponseBody
+
+	if int64(len(tokens)) > limit {
+		last := tokens[limit-1]
+
+		cursor, err := query.EncodeCursor(last.SortValue(query.Sort), last.ID)
+
+		if err != nil {
+			return err
+		}
+
+		tokens = tokens[:limit]
+		result.NextCursor = &cursor
+	}
+
+	var (
+		now   = time.Now()
+		items = make([]*TokenResponseBody, 0, len(tokens))
+	)
+
+	for _, token := range tokens {
+		items = append(items, &TokenResponseBody{Token: token, Expired: token.IsExpired(now)})
+	}
+
+	result.Items = items
+
+	return ctx.JSON(result)
 }
 
 // PostApplicationTokensHandler creates a new token for the application using the body data provided.
 func PostApplicationTokensHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
 	app := ctx.Locals("application").(*Application)
 
 	var requestBody PostApplicationTokensRequestBody
@@ -425,102 +761,502 @@ func PostApplicationTokensHandler(ctx *fiber.Ctx) error {
 		return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %s", err))
 	}
 
+	if err := validate.Struct(requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	scopes := requestBody.Scopes
+
+	if len(scopes) < 1 {
+		scopes = DefaultTokenScopes
+	}
+
+	for _, scope := range scopes {
+		if !IsTokenScope(scope) {
+			return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Unknown token scope: %s", scope))
+		}
+	}
+
+	restrictions, err := NormalizeTokenRestrictions(requestBody.AllowedCIDRs, requestBody.AllowedReferrers)
+
+	if err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	now := time.Now().UTC()
+
+	expiresAt, err := ResolveTokenExpiry(app, requestBody.ExpiresAt, requestBody.TTL, now)
+
+	if err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	secret, prefix := GenerateAPIToken()
+
 	tokenDocument := Token{
-		ID:           RandomHexString(12),
-		Name:         requestBody.Name,
-		Token:        RandomHexString(16),
-		RequestCount: 0,
-		Application:  app.ID,
-		CreatedAt:    time.Now().UTC(),
-		LastUsedAt:   nil,
+		ID:                RandomHexString(12),
+		Name:              requestBody.Name,
+		Prefix:            prefix,
+		Hash:              HashAPIToken(secret),
+		RequestCount:      0,
+		Application:       app.ID,
+		CreatedAt:         now,
+		LastUsedAt:        nil,
+		ExpiresAt:         expiresAt,
+		Scopes:            scopes,
+		TokenRestrictions: restrictions,
+	}
+
+	if err := store.InsertToken(tokenDocument); err != nil {
+		return err
+	}
+
+	EmitWebhookEvent(store, app.ID, "token.created", &tokenDocument)
+
+	return ctx.Status(http.StatusCreated).JSON(&PostApplicationTokensResponseBody{
+		Token:  &tokenDocument,
+		Secret: secret,
+	})
+}
+
+// PatchApplicationTokenHandler changes the fields of the token that are present in the body. An expiresAt of 0
+// removes the expiry of the token, unless the plan of the application limits the lifetime of tokens.
+func PatchApplicationTokenHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	app := ctx.Locals("application").(*Application)
+	token := ctx.Locals("token").(*Token)
+
+	var requestBody PatchApplicationTokenRequestBody
+
+	if err := ctx.BodyParser(&requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %s", err))
+	}
+
+	if err := validate.Struct(requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	fields := Fields{}
+
+	if requestBody.Name != nil {
+		fields["name"] = *requestBody.Name
 	}
 
-	if err := db.InsertToken(tokenDocument); err != nil {
+	if requestBody.ExpiresAt != nil || requestBody.TTL != nil {
+		requestedExpiresAt := requestBody.ExpiresAt
+
+		if requestedExpiresAt != nil && *requestedExpiresAt == 0 && requestBody.TTL == nil {
+			requestedExpiresAt = nil
+		}
+
+		expiresAt, err := ResolveTokenExpiry(app, requestedExpiresAt, requestBody.TTL, time.Now().UTC())
+
+		if err != nil {
+			return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+		}
+
+		fields["expiresAt"] = expiresAt
+	}
+
+	if requestBody.Scopes != nil {
+		if len(requestBody.Scopes) < 1 {
+			return ctx.Status(http.StatusBadRequest).SendString("A token must have at least one scope")
+		}
+
+		for _, scope := range requestBody.Scopes {
+			if !IsTokenScope(scope) {
+				return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Unknown token scope: %s", scope))
+			}
+		}
+
+		fields["scopes"] = requestBody.Scopes
+	}
+
+	if requestBody.AllowedCIDRs != nil || requestBody.AllowedReferrers != nil {
+		restrictions, err := NormalizeTokenRestrictions(requestBody.AllowedCIDRs, requestBody.AllowedReferrers)
+
+		if err != nil {
+			return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+		}
+
+		if requestBody.AllowedCIDRs != nil {
+			fields["allowedCidrs"] = restrictions.AllowedCIDRs
+		}
+
+		if requestBody.AllowedReferrers != nil {
+			fields["allowedReferrers"] = restrictions.AllowedReferrers
+		}
+	}
+
+	if requestBody.Disabled != nil {
+		fields["disabled"] = *requestBody.Disabled
+	}
+
+	if len(fields) < 1 {
+		return ctx.JSON(token)
+	}
+
+	result, err := UpdateToken(store, token, fields)
+
+	if err != nil {
 		return err
 	}
 
-	return ctx.Status(http.StatusCreated).JSON(tokenDocument)
+	return ctx.JSON(result)
 }
 
-// DeleteApplicationTokenHandler deletes the specified application token.
+// DeleteApplicationTokenHandler deletes the specified application token, which can be restored until the grace
+// period has passed.
 func DeleteApplicationTokenHandler(ctx *fiber.Ctx) error {
-	token, err := db.GetTokenByID(ctx.Params("tokenID"))
+	store := ctx.Locals("store").(Store)
+	token := ctx.Locals("token").(*Token)
+
+	if err := DeleteToken(store, token); err != nil {
+		return err
+	}
+
+	return ctx.SendStatus(http.StatusOK)
+}
+
+// PostApplicationTokenRestoreHandler restores the deleted application token if it is within the grace period.
+func PostApplicationTokenRestoreHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	token := ctx.Locals("token").(*Token)
+
+	if !IsRestorable(token.DeletedAt) {
+		return ctx.Status(http.StatusGone).SendString("The token was deleted too long ago to be restored")
+	}
+
+	if err := RestoreToken(store, token); err != nil {
+		return err
+	}
+
+	return ctx.JSON(token)
+}
+
+// PostApplicationTokenRotateHandler issues a new secret for the token, keeping the previous secret valid for
+// the rotation grace period.
+func PostApplicationTokenRotateHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	token := ctx.Locals("token").(*Token)
+
+	secret, err := RotateToken(store, token)
+
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(&PostApplicationTokensResponseBody{
+		Token:  token,
+		Secret: secret,
+	})
+}
+
+// GetApplicationWebhooksHandler returns the webhooks registered for the application.
+func GetApplicationWebhooksHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	application := ctx.Locals("application").(*Application)
+
+	webhooks, err := store.GetWebhooksByApplication(application.ID)
 
 	if err != nil {
 		return err
 	}
 
-	if token == nil {
-		return ctx.Status(http.StatusNotFound).SendString("No token was found by that ID")
+	return ctx.JSON(webhooks)
+}
+
+// PostApplicationWebhooksHandler registers a new webhook for the application using the body data provided.
+func PostApplicationWebhooksHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	application := ctx.Locals("application").(*Application)
+
+	var requestBody PostApplicationWebhooksRequestBody
+
+	if err := ctx.BodyParser(&requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %s", err))
+	}
+
+	if err := validate.Struct(requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
 	}
 
-	if err = db.DeleteTokenByID(token.ID); err != nil {
+	if err := ValidateWebhookURL(requestBody.URL); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	for _, event := range requestBody.Events {
+		if !IsWebhookEvent(event) {
+			return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Unknown webhook event: %s", event))
+		}
+	}
+
+	webhookDocument := Webhook{
+		ID:          RandomHexString(12),
+		Application: application.ID,
+		URL:         requestBody.URL,
+		Secret:      RandomHexString(24),
+		Events:      requestBody.Events,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	if err := store.InsertWebhook(webhookDocument); err != nil {
+		return err
+	}
+
+	return ctx.Status(http.StatusCreated).JSON(&PostApplicationWebhooksResponseBody{
+		Webhook: &webhookDocument,
+		Secret:  webhookDocument.Secret,
+	})
+}
+
+// DeleteApplicationWebhookHandler deletes the specified webhook of the application.
+func DeleteApplicationWebhookHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	webhook := ctx.Locals("webhook").(*Webhook)
+
+	if err := store.DeleteWebhookByID(webhook.ID); err != nil {
 		return err
 	}
 
 	return ctx.SendStatus(http.StatusOK)
 }
 
+// GetApplicationWebhookDeliveriesHandler returns the most recent deliveries of the webhook.
+func GetApplicationWebhookDeliveriesHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	webhook := ctx.Locals("webhook").(*Webhook)
+
+	limit := ctx.QueryInt("limit", 50)
+
+	if limit < 1 || limit > 100 {
+		return ctx.Status(http.StatusBadRequest).SendString("limit must be between 1 and 100")
+	}
+
+	deliveries, err := store.GetWebhookDeliveriesByWebhook(webhook.ID, int64(limit))
+
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(deliveries)
+}
+
+// GetApplicationNotificationsHandler returns the notification preferences of the application.
+func GetApplicationNotificationsHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	application := ctx.Locals("application").(*Application)
+
+	preferences, err := store.GetNotificationPreferences(application.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if preferences == nil {
+		preferences = DefaultNotificationPreferences(application.ID)
+	}
+
+	return ctx.JSON(preferences)
+}
+
+// PostApplicationNotificationsHandler updates the notification preferences of the application.
+func PostApplicationNotificationsHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	application := ctx.Locals("application").(*Application)
+
+	var requestBody PostApplicationNotificationsRequestBody
+
+	if err := ctx.BodyParser(&requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %s", err))
+	}
+
+	if err := validate.Struct(requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	if len(requestBody.WebhookURL) > 0 {
+		if err := ValidateWebhookURL(requestBody.WebhookURL); err != nil {
+			return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+		}
+	}
+
+	preferences, err := store.GetNotificationPreferences(application.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if preferences == nil {
+		preferences = DefaultNotificationPreferences(application.ID)
+	}
+
+	preferences.Email = requestBody.Email
+	preferences.WebhookURL = requestBody.WebhookURL
+	preferences.QuotaAlerts = requestBody.QuotaAlerts
+	preferences.SpikeAlerts = requestBody.SpikeAlerts
+
+	if len(preferences.WebhookURL) > 0 && len(preferences.WebhookSecret) < 1 {
+		preferences.WebhookSecret = RandomHexString(24)
+	}
+
+	if err := store.UpsertNotificationPreferences(*preferences); err != nil {
+		return err
+	}
+
+	return ctx.JSON(preferences)
+}
+
+// GetApplicationQuotaHandler returns the remaining request allowance of the application for the current period.
+func GetApplicationQuotaHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	quota, err := GetApplicationQuota(store, ctx.Locals("application").(*Application))
+
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(quota)
+}
+
 // GetApplicationUsageHandler returns the usage data for the application.
 func GetApplicationUsageHandler(ctx *fiber.Ctx) error {
-	var (
-		fromQuery = ctx.Query("from", strconv.FormatInt(time.Now().Add(-time.Hour*24).UnixMilli(), 10))
-		toQuery   = ctx.Query("to", strconv.FormatInt(time.Now().UnixMilli(), 10))
+	store := ctx.Locals("store").(Store)
+	application := ctx.Locals("application").(*Application)
 
-		fromDate time.Time
-		toDate   time.Time
-	)
+	query, err := ParseUsageQuery(ctx)
 
-	{
-		value, err := strconv.ParseInt(fromQuery, 10, 64)
+	if err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
 
-		if err != nil {
-			return err
-		}
+	query.Application = application.ID
 
-		fromDate = time.UnixMilli(value).Truncate(UsageChartInterval)
+	buckets, err := store.GetRequestLogBuckets(query)
+
+	if err != nil {
+		return err
 	}
 
-	{
-		value, err := strconv.ParseInt(toQuery, 10, 64)
+	if !query.GroupByToken {
+		return ctx.JSON(FillUsageBuckets(query, buckets))
+	}
 
-		if err != nil {
-			return err
-		}
+	tokens, err := store.GetTokensByApplication(application.ID, &ListQuery{Sort: "name", Direction: "ascending"})
 
-		toDate = time.UnixMilli(value)
+	if err != nil {
+		return err
 	}
 
+	return ctx.JSON(GroupUsageBucketsByToken(query, tokens, buckets))
+}
+
+// GetApplicationUsageExportHandler streams the raw or grouped usage data for the application as CSV or NDJSON.
+func GetApplicationUsageExportHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
 	application := ctx.Locals("application").(*Application)
 
-	logs, err := db.GetRequestLogsByApplication(application.ID, fromDate, toDate)
+	export, err := ParseUsageExport(ctx)
+
+	if err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	export.Query.Application = application.ID
+
+	ctx.Set(fiber.HeaderContentType, UsageExportFormats[export.Format])
+	ctx.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"usage-%s.%s\"", application.ID, export.Format))
+
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := WriteUsageExport(store, w, export); err != nil {
+			log.Printf("Error: failed to export usage for application %s: %v\n", export.Query.Application, err)
+		}
+	})
+
+	return nil
+}
+
+// GetApplicationTokenUsageHandler returns the usage data for a single token of the application.
+func GetApplicationTokenUsageHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+	token := ctx.Locals("token").(*Token)
+
+	query, err := ParseUsageQuery(ctx)
+
+	if err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	if query.GroupByToken {
+		return ctx.Status(http.StatusBadRequest).SendString("groupBy is not supported for token usage")
+	}
+
+	query.Application = token.Application
+	query.Token = token.ID
+
+	buckets, err := store.GetRequestLogBuckets(query)
 
 	if err != nil {
 		return err
 	}
 
-	var (
-		result      = make([]*UsageLogResponseBody, 0)
-		currentDate = fromDate
-	)
+	return ctx.JSON(FillUsageBuckets(query, buckets))
+}
 
-	for currentDate.Compare(toDate) < 0 {
-		var requestCount int64 = 0
+// PostInternalTokenIntrospectHandler validates a raw API token on behalf of another service. If the token is
+// restricted to certain IP addresses or referrers, allowed reports whether the request made with it may use it.
+func PostInternalTokenIntrospectHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
 
-		for _, v := range logs {
-			if v.Timestamp.Compare(currentDate.Add(UsageChartInterval)) >= 0 || v.Timestamp.Compare(currentDate) < 0 {
-				continue
-			}
+	var requestBody PostInternalTokenIntrospectRequestBody
+
+	if err := ctx.BodyParser(&requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %s", err))
+	}
 
-			requestCount += v.RequestCount
+	if err := validate.Struct(requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	result, err := IntrospectToken(store, requestBody.Token)
+
+	if err != nil {
+		return err
+	}
+
+	response := &PostInternalTokenIntrospectResponseBody{
+		TokenIntrospection: result,
+		Allowed:            result.Active,
+	}
+
+	if result.Active {
+		if err := result.Allows(requestBody.IP, requestBody.Referer); err != nil {
+			response.Allowed = false
+			response.DeniedReason = err.Error()
 		}
+	}
 
-		result = append(result, &UsageLogResponseBody{
-			Timestamp:    currentDate.Format(time.RFC3339),
-			RequestCount: requestCount,
-		})
+	return ctx.JSON(response)
+}
 
-		currentDate = currentDate.Add(UsageChartInterval)
+// PostInternalUsageHandler records a batch of token usage events reported by another service.
+func PostInternalUsageHandler(ctx *fiber.Ctx) error {
+	store := ctx.Locals("store").(Store)
+
+	var requestBody PostInternalUsageRequestBody
+
+	if err := ctx.BodyParser(&requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(fmt.Sprintf("Invalid request body: %s", err))
+	}
+
+	if err := validate.Struct(requestBody); err != nil {
+		return ctx.Status(http.StatusBadRequest).SendString(err.Error())
+	}
+
+	result, err := IngestUsageBatch(store, requestBody.BatchID, requestBody.Events)
+
+	if err != nil {
+		return err
 	}
 
 	return ctx.JSON(result)
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func newTestApp(t *testing.T) (*fiber.App, *MemoryStore) {
+	t.Helper()
+
+	passwordHasher = &BcryptHasher{Cost: 4}
+
+	store := NewMemoryStore()
+
+	return NewApp(store), store
+}
+
+func doRequest(t *testing.T, app *fiber.App, method, path, session string, body interface{}) (int, []byte) {
+	t.Helper()
+
+	var reader io.Reader
+
+	if body != nil {
+		data, err := json.Marshal(body)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if len(session) > 0 {
+		req.Header.Set("Authorization", session)
+	}
+
+	res, err := app.Test(req, -1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, data
+}
+
+func signup(t *testing.T, app *fiber.App, email string) *Session {
+	t.Helper()
+
+	status, data := doRequest(t, app, http.MethodPost, "/auth/signup", "", PostSignupRequestBody{
+		Email:           email,
+		Password:        "password",
+		ConfirmPassword: "password",
+	})
+
+	if status != http.StatusCreated {
+		t.Fatalf("signup returned %d: %s", status, data)
+	}
+
+	var session Session
+
+	if err := json.Unmarshal(data, &session); err != nil {
+		t.Fatal(err)
+	}
+
+	return &session
+}
+
+func TestPingHandler(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	if status, _ := doRequest(t, app, http.MethodGet, "/ping", "", nil); status != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, status)
+	}
+}
+
+func TestSignupHandler(t *testing.T) {
+	app, store := newTestApp(t)
+
+	session := signup(t, app, "user@example.com")
+
+	user, err := store.GetUserByEmail("user@example.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user == nil || user.ID != session.User {
+		t.Fatalf("expected the session to belong to the new user, got %+v", user)
+	}
+
+	status, data := doRequest(t, app, http.MethodPost, "/auth/signup", "", PostSignupRequestBody{
+		Email:           "user@example.com",
+		Password:        "password",
+		ConfirmPassword: "password",
+	})
+
+	if status != http.StatusConflict {
+		t.Fatalf("expected %d for an existing email, got %d: %s", http.StatusConflict, status, data)
+	}
+
+	if status, data := doRequest(t, app, http.MethodGet, "/users/@me", session.ID, nil); status != http.StatusOK {
+		t.Fatalf("expected %d for the new session, got %d: %s", http.StatusOK, status, data)
+	}
+}
+
+func createApplication(t *testing.T, app *fiber.App, session *Session) *Application {
+	t.Helper()
+
+	status, data := doRequest(t, app, http.MethodPost, "/applications", session.ID, PostApplicationsRequestBody{
+		Name:             "Test Application",
+		ShortDescription: "An application that is used by the route tests.",
+	})
+
+	if status != http.StatusCreated {
+		t.Fatalf("creating the application returned %d: %s", status, data)
+	}
+
+	var application Application
+
+	if err := json.Unmarshal(data, &application); err != nil {
+		t.Fatal(err)
+	}
+
+	return &application
+}
+
+func TestPostApplicationHandler(t *testing.T) {
+	app, store := newTestApp(t)
+
+	owner := signup(t, app, "owner@example.com")
+	other := signup(t, app, "other@example.com")
+	application := createApplication(t, app, owner)
+
+	body := PostApplicationRequestBody{
+		Name:             "Renamed Application",
+		ShortDescription: "An application that has been renamed by the route tests.",
+	}
+
+	tests := []struct {
+		name    string
+		session string
+		status  int
+	}{
+		{"unauthenticated", "", http.StatusUnauthorized},
+		{"not the owner", other.ID, http.StatusForbidden},
+		{"owner", owner.ID, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, data := doRequest(t, app, http.MethodPost, "/applications/"+application.ID, test.session, body); status != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, status, data)
+			}
+		})
+	}
+
+	result, err := store.GetApplicationByID(application.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result == nil || result.Name != body.Name || result.ShortDescription != body.ShortDescription {
+		t.Fatalf("expected the owner's update to be saved, got %+v", result)
+	}
+}
+
+func TestDeleteApplicationHandler(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	owner := signup(t, app, "owner@example.com")
+	other := signup(t, app, "other@example.com")
+	application := createApplication(t, app, owner)
+
+	tests := []struct {
+		name    string
+		session string
+		status  int
+	}{
+		{"unauthenticated", "", http.StatusUnauthorized},
+		{"not the owner", other.ID, http.StatusForbidden},
+		{"owner", owner.ID, http.StatusOK},
+		{"already deleted", owner.ID, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, data := doRequest(t, app, http.MethodDelete, "/applications/"+application.ID, test.session, nil); status != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, status, data)
+			}
+		})
+	}
+
+	if status, data := doRequest(t, app, http.MethodGet, "/applications/"+application.ID, owner.ID, nil); status != http.StatusNotFound {
+		t.Fatalf("expected the deleted application to be hidden, got %d: %s", status, data)
+	}
+}
+
+func createToken(t *testing.T, app *fiber.App, session *Session, application *Application) *PostApplicationTokensResponseBody {
+	t.Helper()
+
+	status, data := doRequest(t, app, http.MethodPost, "/applications/"+application.ID+"/tokens", session.ID, PostApplicationTokensRequestBody{Name: "Test Token"})
+
+	if status != http.StatusCreated {
+		t.Fatalf("creating the token returned %d: %s", status, data)
+	}
+
+	var token PostApplicationTokensResponseBody
+
+	if err := json.Unmarshal(data, &token); err != nil {
+		t.Fatal(err)
+	}
+
+	return &token
+}
+
+func TestDeleteRotatedToken(t *testing.T) {
+	app, store := newTestApp(t)
+
+	session := signup(t, app, "owner@example.com")
+	application := createApplication(t, app, session)
+	token := createToken(t, app, session, application)
+
+	status, data := doRequest(t, app, http.MethodPost, "/applications/"+application.ID+"/tokens/"+token.ID+"/rotate", session.ID, nil)
+
+	if status != http.StatusOK {
+		t.Fatalf("rotating the token returned %d: %s", status, data)
+	}
+
+	// The previous secret is introspected once so that its result is cached.
+	if introspection, err := IntrospectToken(store, token.Secret); err != nil || !introspection.Active {
+		t.Fatalf("expected the previous secret to be active during the grace period, got %+v, %v", introspection, err)
+	}
+
+	if status, data := doRequest(t, app, http.MethodDelete, "/applications/"+application.ID+"/tokens/"+token.ID, session.ID, nil); status != http.StatusOK {
+		t.Fatalf("deleting the token returned %d: %s", status, data)
+	}
+
+	if introspection, err := IntrospectToken(store, token.Secret); err != nil || introspection.Active {
+		t.Fatalf("expected the previous secret to be inactive after the token was deleted, got %+v, %v", introspection, err)
+	}
+}
+
+// countingStore counts the request log aggregations, which token introspection should not run on every cache miss.
+type countingStore struct {
+	*MemoryStore
+	Sums int
+}
+
+func (s *countingStore) SumRequestLogs(application string, from, to time.Time) (int64, error) {
+	s.Sums++
+
+	return s.MemoryStore.SumRequestLogs(application, from, to)
+}
+
+func TestIntrospectionCachesQuota(t *testing.T) {
+	app, memory := newTestApp(t)
+	store := &countingStore{MemoryStore: memory}
+
+	session := signup(t, app, "owner@example.com")
+	application := createApplication(t, app, session)
+	token := createToken(t, app, session, application)
+
+	quotaCache.Invalidate(application.ID)
+
+	for i := 0; i < 3; i++ {
+		introspectionCache.Invalidate(HashAPIToken(token.Secret))
+
+		if introspection, err := IntrospectToken(store, token.Secret); err != nil || !introspection.Active {
+			t.Fatalf("expected the token to be active, got %+v, %v", introspection, err)
+		}
+	}
+
+	if store.Sums != 1 {
+		t.Fatalf("expected the request log to be aggregated once, got %d aggregations", store.Sums)
+	}
+}
+
+func TestCORSAllowsPatch(t *testing.T) {
+	environment := config.Environment
+	config.Environment = "development"
+
+	defer func() {
+		config.Environment = environment
+	}()
+
+	app, _ := newTestApp(t)
+
+	req := httptest.NewRequest(http.MethodOptions, "/applications/application/tokens/token", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+
+	res, err := app.Test(req, -1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if methods := res.Header.Get("Access-Control-Allow-Methods"); !strings.Contains(methods, http.MethodPatch) {
+		t.Fatalf("expected PATCH to be an allowed method, got %q", methods)
+	}
+}
+
+func TestTokenAllowedCIDRsBehindProxy(t *testing.T) {
+	proxy := config.Proxy
+
+	defer func() {
+		config.Proxy = proxy
+	}()
+
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		status         int
+	}{
+		{"untrusted proxy", []string{}, http.StatusForbidden},
+		{"trusted proxy", []string{"0.0.0.0/8"}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config.Proxy.TrustedProxies = test.trustedProxies
+
+			app, _ := newTestApp(t)
+
+			session := signup(t, app, "owner@example.com")
+			application := createApplication(t, app, session)
+
+			status, data := doRequest(t, app, http.MethodPost, "/applications/"+application.ID+"/tokens", session.ID, PostApplicationTokensRequestBody{
+				Name:         "Test Token",
+				Scopes:       []string{"usage:read"},
+				AllowedCIDRs: []string{"203.0.113.0/24"},
+			})
+
+			if status != http.StatusCreated {
+				t.Fatalf("creating the token returned %d: %s", status, data)
+			}
+
+			var token PostApplicationTokensResponseBody
+
+			if err := json.Unmarshal(data, &token); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/applications/"+application.ID+"/quota", nil)
+			req.Header.Set("Authorization", token.Secret)
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+			res, err := app.Test(req, -1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Fatalf("expected %d, got %d", test.status, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestGetApplicationHandler(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	owner := signup(t, app, "owner@example.com")
+	other := signup(t, app, "other@example.com")
+	application := createApplication(t, app, owner)
+
+	tests := []struct {
+		name    string
+		session string
+		private bool
+	}{
+		{"unauthenticated", "", false},
+		{"invalid session", "invalid", false},
+		{"invalid token", "mcs_00000000_invalid", false},
+		{"not the owner", other.ID, false},
+		{"owner", owner.ID, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, data := doRequest(t, app, http.MethodGet, "/applications/"+application.ID, test.session, nil)
+
+			if status != http.StatusOK {
+				t.Fatalf("expected %d, got %d: %s", http.StatusOK, status, data)
+			}
+
+			var body map[string]interface{}
+
+			if err := json.Unmarshal(data, &body); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok := body["tokenPrefix"]; ok != test.private {
+				t.Fatalf("expected the private fields to be returned only to the owner (private: %v), got %s", test.private, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrSessionExpired is returned when a session exists but has passed its absolute or idle expiry.
+	ErrSessionExpired = errors.New("session has expired")
+)
+
+// NewSession returns a new session document for the user, recording the client it was created from.
+func NewSession(user, ip, userAgent string) Session {
+	now := time.Now().UTC()
+
+	session := Session{
+		ID:         RandomHexString(16),
+		PublicID:   RandomHexString(8),
+		User:       user,
+		IP:         ip,
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastUsedAt: now,
+	}
+
+	session.ExpiresAt = session.ExpiryTime()
+
+	return session
+}
+
+// ExpiryTime returns the time the session expires using the current configuration, or nil if it never expires.
+func (s *Session) ExpiryTime() *time.Time {
+	var result *time.Time
+
+	if config.Sessions.MaxAge > 0 {
+		value := s.CreatedAt.Add(config.Sessions.MaxAge)
+
+		result = &value
+	}
+
+	if config.Sessions.IdleTimeout > 0 {
+		lastUsedAt := s.LastUsedAt
+
+		if lastUsedAt.IsZero() {
+			lastUsedAt = s.CreatedAt
+		}
+
+		value := lastUsedAt.Add(config.Sessions.IdleTimeout)
+
+		if result == nil || value.Before(*result) {
+			result = &value
+		}
+	}
+
+	return result
+}
+
+// IsExpired returns whether the session has expired at the given time.
+func (s *Session) IsExpired(now time.Time) bool {
+	expiresAt := s.ExpiryTime()
+
+	return expiresAt != nil && !now.Before(*expiresAt)
+}
+
+// GetActiveSession returns the session by ID, or nil if it does not exist. If the session has expired,
+// it is deleted and ErrSessionExpired is returned. The last used time is updated at most once every
+// touch interval to avoid a write on every request.
+func GetActiveSession(store Store, id string) (*Session, error) {
+	session, err := store.GetSessionByID(id)
+
+	if err != nil || session == nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	if session.IsExpired(now) {
+		if err := store.DeleteSessionByID(session.ID); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrSessionExpired
+	}
+
+	if now.Sub(session.LastUsedAt) >= config.Sessions.TouchInterval {
+		session.LastUsedAt = now
+		session.ExpiresAt = session.ExpiryTime()
+
+		if len(session.PublicID) < 1 {
+			session.PublicID = RandomHexString(8)
+		}
+
+		if err := store.UpdateSessionByID(session.ID, Fields{
+			"publicId":   session.PublicID,
+			"lastUsedAt": session.LastUsedAt,
+			"expiresAt":  session.ExpiresAt,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
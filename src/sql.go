@@ -0,0 +1,1501 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	sqlite "github.com/glebarez/go-sqlite"
+	"github.com/lib/pq"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var (
+	sqlUserColumns        string = "id, email, password, type, created_at"
+	sqlSessionColumns     string = "id, public_id, user_id, ip, user_agent, created_at, last_used_at, expires_at"
+	sqlApplicationColumns string = "id, name, short_description, user_id, token_prefix, token_hash, plan, request_count, created_at, deleted_at"
+	sqlTokenColumns       string = "id, name, prefix, hash, request_count, application, created_at, last_used_at, deleted_at, previous_secret_hash, previous_secret_expires_at, expires_at, scopes, allowed_cidrs, allowed_referrers, disabled"
+	sqlWebhookColumns     string = "id, application, url, secret, events, created_at"
+	sqlDeliveryColumns    string = "id, webhook, application, event, url, payload, status, attempts, next_attempt_at, locked_until, last_error, response_status, created_at, delivered_at"
+
+	sqlLikeReplacer *strings.Replacer = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+)
+
+// SQLStore is a store backed by a PostgreSQL or SQLite database through database/sql.
+type SQLStore struct {
+	DB     *sql.DB
+	Driver string
+}
+
+type sqlRow interface {
+	Scan(dest ...interface{}) error
+}
+
+func (c *SQLStore) Connect(uri string) error {
+	var dsn string
+
+	switch scheme := strings.SplitN(uri, ":", 2)[0]; scheme {
+	case "postgres", "postgresql":
+		c.Driver = "postgres"
+		dsn = uri
+	case "sqlite", "sqlite3":
+		c.Driver = "sqlite"
+		dsn = strings.TrimPrefix(uri, scheme+"://")
+	default:
+		return fmt.Errorf("unsupported database scheme: %s", scheme)
+	}
+
+	if c.Driver == "sqlite" {
+		separator := "?"
+
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+
+		dsn += separator + "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	}
+
+	db, err := sql.Open(c.Driver, dsn)
+
+	if err != nil {
+		return err
+	}
+
+	if c.Driver == "sqlite" {
+		// SQLite only allows a single writer, so sharing one connection avoids lock errors under load.
+		db.SetMaxOpenConns(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	c.DB = db
+
+	return nil
+}
+
+func (c *SQLStore) SchemaVersion() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	if _, err := c.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at BIGINT NOT NULL)"); err != nil {
+		return 0, err
+	}
+
+	var version int
+
+	if err := c.DB.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func (c *SQLStore) Migrate(target int) error {
+	current, err := c.SchemaVersion()
+
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range SQLMigrations {
+		if migration.Version <= current || migration.Version > target {
+			continue
+		}
+
+		if err := c.applyMigration(migration.Version, migration.Up, true); err != nil {
+			return fmt.Errorf("migration %d: %w", migration.Version, err)
+		}
+
+		log.Printf("Applied database migration %d\n", migration.Version)
+	}
+
+	for i := len(SQLMigrations) - 1; i >= 0; i-- {
+		migration := SQLMigrations[i]
+
+		if migration.Version > current || migration.Version <= target {
+			continue
+		}
+
+		if err := c.applyMigration(migration.Version, migration.Down, false); err != nil {
+			return fmt.Errorf("migration %d: %w", migration.Version, err)
+		}
+
+		log.Printf("Reverted database migration %d\n", migration.Version)
+	}
+
+	return nil
+}
+
+func (c *SQLStore) applyMigration(version int, statements []string, up bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	defer cancel()
+
+	tx, err := c.DB.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, c.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), version, time.Now().UnixMilli())
+	} else {
+		_, err = tx.ExecContext(ctx, c.rebind("DELETE FROM schema_migrations WHERE version = ?"), version)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (c *SQLStore) InsertUser(document User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.DB.ExecContext(
+		ctx,
+		c.rebind("INSERT INTO users ("+sqlUserColumns+") VALUES (?, ?, ?, ?, ?)"),
+		document.ID, document.Email, document.Password, document.Type, toMillis(document.CreatedAt),
+	)
+
+	return c.wrapError(err)
+}
+
+func (c *SQLStore) InsertSession(document Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	// Stands in for the TTL index used by MongoDB to remove expired sessions.
+	if _, err := c.DB.ExecContext(ctx, c.rebind("DELETE FROM sessions WHERE expires_at <= ?"), time.Now().UnixMilli()); err != nil {
+		return err
+	}
+
+	_, err := c.DB.ExecContext(
+		ctx,
+		c.rebind("INSERT INTO sessions ("+sqlSessionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)"),
+		document.ID, document.PublicID, document.User, document.IP, document.UserAgent, toMillis(document.CreatedAt), toMillis(document.LastUsedAt), toNullMillis(document.ExpiresAt),
+	)
+
+	return c.wrapError(err)
+}
+
+func (c *SQLStore) InsertApplication(document Application) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.DB.ExecContext(
+		ctx,
+		c.rebind("INSERT INTO applications ("+sqlApplicationColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		document.ID, document.Name, document.ShortDescription, document.User, document.TokenPrefix, document.TokenHash, document.Plan, int64(document.RequestCount), toMillis(document.CreatedAt), toNullMillis(document.DeletedAt),
+	)
+
+	return c.wrapError(err)
+}
+
+func (c *SQLStore) InsertToken(document Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.DB.ExecContext(
+		ctx,
+		c.rebind("INSERT INTO tokens ("+sqlTokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		document.ID, document.Name, document.Prefix, document.Hash, int64(document.RequestCount), document.Application, toMillis(document.CreatedAt), toNullMillis(document.LastUsedAt), toNullMillis(document.DeletedAt), document.PreviousSecretHash, toNullMillis(document.PreviousSecretExpiresAt), toNullMillis(document.ExpiresAt), toSQLValue(document.Scopes), toSQLValue(document.AllowedCIDRs), toSQLValue(document.AllowedReferrers), document.Disabled,
+	)
+
+	return c.wrapError(err)
+}
+
+func (c *SQLStore) InsertUsageBatch(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	now := time.Now()
+
+	// Stands in for the TTL index used by MongoDB to forget batches after a week.
+	if _, err := c.DB.ExecContext(ctx, c.rebind("DELETE FROM usage_batches WHERE created_at < ?"), now.Add(-time.Hour*24*7).UnixMilli()); err != nil {
+		return false, err
+	}
+
+	// A batch that has not been applied is claimed again once the lease of the request that claimed it runs out.
+	result, err := c.DB.ExecContext(
+		ctx,
+		c.rebind(`INSERT INTO usage_batches (id, created_at, locked_until, completed) VALUES (?, ?, ?, FALSE)
+			ON CONFLICT (id) DO UPDATE SET locked_until = excluded.locked_until
+			WHERE NOT usage_batches.completed AND usage_batches.locked_until <= ?`),
+		id, now.UnixMilli(), now.Add(UsageBatchLease).UnixMilli(), now.UnixMilli(),
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := result.RowsAffected()
+
+	return inserted > 0, err
+}
+
+func (c *SQLStore) InsertWebhook(document Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	events, err := json.Marshal(document.Events)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = c.DB.ExecContext(
+		ctx,
+		c.rebind("INSERT INTO webhooks ("+sqlWebhookColumns+") VALUES (?, ?, ?, ?, ?, ?)"),
+		document.ID, document.Application, document.URL, document.Secret, string(events), toMillis(document.CreatedAt),
+	)
+
+	return c.wrapError(err)
+}
+
+func (c *SQLStore) InsertWebhookDeliveries(documents []WebhookDelivery) error {
+	if len(documents) < 1 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	tx, err := c.DB.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, document := range documents {
+		if _, err := tx.ExecContext(
+			ctx,
+			c.rebind("INSERT INTO webhook_deliveries ("+sqlDeliveryColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+			document.ID, document.Webhook, document.Application, document.Event, document.URL, document.Payload, document.Status, document.Attempts,
+			toMillis(document.NextAttemptAt), toNullMillis(document.LockedUntil), document.LastError, document.ResponseStatus, toMillis(document.CreatedAt), toNullMillis(document.DeliveredAt),
+		); err != nil {
+			return c.wrapError(err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (c *SQLStore) InsertAlert(id, application string, expiresAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	now := time.Now().UnixMilli()
+
+	// An expired alert is replaced as if it had been removed by a TTL index.
+	result, err := c.DB.ExecContext(
+		ctx,
+		c.rebind(`INSERT INTO alerts (id, application, created_at, expires_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET application = excluded.application, created_at = excluded.created_at, expires_at = excluded.expires_at
+			WHERE alerts.expires_at <= ?`),
+		id, application, now, toMillis(expiresAt), now,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	inserted, err := result.RowsAffected()
+
+	return inserted > 0, err
+}
+
+func (c *SQLStore) IncrementUsage(batchID string, increments []*UsageIncrement) error {
+	if len(increments) < 1 {
+		return nil
+	}
+
+	var (
+		tokenCounts       = make(map[string]int64)
+		tokenLastUsedAt   = make(map[string]time.Time)
+		applicationCounts = make(map[string]int64)
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+
+	defer cancel()
+
+	tx, err := c.DB.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// Marking the batch as applied locks it, so a retry whose lease ran out while this one was still applying
+	// the batch waits for it and then finds the batch already applied.
+	result, err := tx.ExecContext(
+		ctx,
+		c.rebind(`INSERT INTO usage_batches (id, created_at, locked_until, completed) VALUES (?, ?, 0, TRUE)
+			ON CONFLICT (id) DO UPDATE SET completed = TRUE WHERE NOT usage_batches.completed`),
+		batchID, time.Now().UnixMilli(),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if marked, err := result.RowsAffected(); err != nil || marked < 1 {
+		return err
+	}
+
+	for _, increment := range increments {
+		if _, err := tx.ExecContext(
+			ctx,
+			c.rebind(`INSERT INTO request_log (id, application, token, timestamp, request_count) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (application, token, timestamp) DO UPDATE SET request_count = request_log.request_count + excluded.request_count`),
+			RandomHexString(12), increment.Application, increment.Token, toMillis(increment.Timestamp), increment.RequestCount,
+		); err != nil {
+			return err
+		}
+
+		tokenCounts[increment.Token] += increment.RequestCount
+		applicationCounts[increment.Application] += increment.RequestCount
+
+		if increment.LastUsedAt.After(tokenLastUsedAt[increment.Token]) {
+			tokenLastUsedAt[increment.Token] = increment.LastUsedAt
+		}
+	}
+
+	for token, count := range tokenCounts {
+		lastUsedAt := toMillis(tokenLastUsedAt[token])
+
+		if _, err := tx.ExecContext(
+			ctx,
+			c.rebind(`UPDATE tokens SET request_count = request_count + ?,
+				last_used_at = CASE WHEN last_used_at IS NULL OR last_used_at < ? THEN ? ELSE last_used_at END
+				WHERE id = ?`),
+			count, lastUsedAt, lastUsedAt, token,
+		); err != nil {
+			return err
+		}
+	}
+
+	for application, count := range applicationCounts {
+		if _, err := tx.ExecContext(ctx, c.rebind("UPDATE applications SET request_count = request_count + ? WHERE id = ?"), count, application); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (c *SQLStore) GetUserByEmail(email string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	return nilIfNoRows(scanUser(c.DB.QueryRowContext(ctx, c.rebind("SELECT "+sqlUserColumns+" FROM users WHERE email = ?"), email)))
+}
+
+func (c *SQLStore) GetUserByID(id string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	return nilIfNoRows(scanUser(c.DB.QueryRowContext(ctx, c.rebind("SELECT "+sqlUserColumns+" FROM users WHERE id = ?"), id)))
+}
+
+func (c *SQLStore) GetSessionByID(id string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	return nilIfNoRows(scanSession(c.DB.QueryRowContext(ctx, c.rebind("SELECT "+sqlSessionColumns+" FROM sessions WHERE id = ?"), id)))
+}
+
+func (c *SQLStore) GetSessionsByUser(user string) ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	rows, err := c.DB.QueryContext(ctx, c.rebind("SELECT "+sqlSessionColumns+" FROM sessions WHERE user_id = ? ORDER BY last_used_at DESC, id"), user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]*Session, 0)
+
+	for rows.Next() {
+		session, err := scanSession(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, session)
+	}
+
+	return result, rows.Err()
+}
+
+func (c *SQLStore) GetTokenByID(id string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	return nilIfNoRows(scanToken(c.DB.QueryRowContext(ctx, c.rebind("SELECT "+sqlTokenColumns+" FROM tokens WHERE id = ?"), id)))
+}
+
+func (c *SQLStore) GetTokenByHash(hash string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	return nilIfNoRows(scanToken(c.DB.QueryRowContext(ctx, c.rebind("SELECT "+sqlTokenColumns+" FROM tokens WHERE hash = ? OR previous_secret_hash = ?"), hash, hash)))
+}
+
+func (c *SQLStore) GetTokenByApplicationAndID(application, id string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	return nilIfNoRows(scanToken(c.DB.QueryRowContext(ctx, c.rebind("SELECT "+sqlTokenColumns+" FROM tokens WHERE id = ? AND application = ?"), id, application)))
+}
+
+func (c *SQLStore) GetApplicationByID(id string) (*Application, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	return nilIfNoRows(scanApplication(c.DB.QueryRowContext(ctx, c.rebind("SELECT "+sqlApplicationColumns+" FROM applications WHERE id = ?"), id)))
+}
+
+func (c *SQLStore) IterateApplications(fn func(*Application) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+
+	defer cancel()
+
+	rows, err := c.DB.QueryContext(ctx, "SELECT "+sqlApplicationColumns+" FROM applications ORDER BY id")
+
+	if err != nil {
+		return err
+	}
+
+	// The applications are read before calling the function so that it can use the store, which would
+	// otherwise wait forever for the connection held by the rows when using SQLite.
+	applications := make([]*Application, 0)
+
+	for rows.Next() {
+		application, err := scanApplication(rows)
+
+		if err != nil {
+			rows.Close()
+
+			return err
+		}
+
+		applications = append(applications, application)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, application := range applications {
+		if err := fn(application); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *SQLStore) GetNotificationPreferences(application string) (*NotificationPreferences, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	var result NotificationPreferences
+
+	err := c.DB.QueryRowContext(
+		ctx,
+		c.rebind("SELECT application, email, webhook_url, webhook_secret, quota_alerts, spike_alerts FROM notification_preferences WHERE application = ?"),
+		application,
+	).Scan(&result.Application, &result.Email, &result.WebhookURL, &result.WebhookSecret, &result.QuotaAlerts, &result.SpikeAlerts)
+
+	return nilIfNoRows(&result, err)
+}
+
+func (c *SQLStore) GetWebhookByID(id string) (*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	return nilIfNoRows(scanWebhook(c.DB.QueryRowContext(ctx, c.rebind("SELECT "+sqlWebhookColumns+" FROM webhooks WHERE id = ?"), id)))
+}
+
+func (c *SQLStore) GetWebhookByApplicationAndID(application, id string) (*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	return nilIfNoRows(scanWebhook(c.DB.QueryRowContext(ctx, c.rebind("SELECT "+sqlWebhookColumns+" FROM webhooks WHERE id = ? AND application = ?"), id, application)))
+}
+
+func (c *SQLStore) GetWebhooksByApplication(application string) ([]*Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	rows, err := c.DB.QueryContext(ctx, c.rebind("SELECT "+sqlWebhookColumns+" FROM webhooks WHERE application = ? ORDER BY created_at, id"), application)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]*Webhook, 0)
+
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, webhook)
+	}
+
+	return result, rows.Err()
+}
+
+func (c *SQLStore) GetWebhookDeliveriesByWebhook(webhook string, limit int64) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	rows, err := c.DB.QueryContext(ctx, c.rebind("SELECT "+sqlDeliveryColumns+" FROM webhook_deliveries WHERE webhook = ? ORDER BY created_at DESC, id LIMIT ?"), webhook, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]*WebhookDelivery, 0)
+
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, delivery)
+	}
+
+	return result, rows.Err()
+}
+
+func (c *SQLStore) ClaimWebhookDelivery(now, lockedUntil time.Time) (*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	// The delivery is claimed with a conditional update, retrying with the next candidate if another
+	// instance claimed it first, since SQLite has no equivalent of SELECT ... FOR UPDATE SKIP LOCKED.
+	for {
+		var id string
+
+		err := c.DB.QueryRowContext(
+			ctx,
+			c.rebind(`SELECT id FROM webhook_deliveries
+				WHERE status = 'pending' AND next_attempt_at <= ? AND (locked_until IS NULL OR locked_until <= ?)
+				ORDER BY next_attempt_at LIMIT 1`),
+			toMillis(now), toMillis(now),
+		).Scan(&id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := c.DB.ExecContext(
+			ctx,
+			c.rebind("UPDATE webhook_deliveries SET locked_until = ? WHERE id = ? AND status = 'pending' AND (locked_until IS NULL OR locked_until <= ?)"),
+			toMillis(lockedUntil), id, toMillis(now),
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if claimed, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if claimed < 1 {
+			continue
+		}
+
+		return nilIfNoRows(scanDelivery(c.DB.QueryRowContext(ctx, c.rebind("SELECT "+sqlDeliveryColumns+" FROM webhook_deliveries WHERE id = ?"), id)))
+	}
+}
+
+func (c *SQLStore) GetDeletedApplications(before time.Time) ([]*Application, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	rows, err := c.DB.QueryContext(ctx, c.rebind("SELECT "+sqlApplicationColumns+" FROM applications WHERE deleted_at <= ?"), toMillis(before))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]*Application, 0)
+
+	for rows.Next() {
+		application, err := scanApplication(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, application)
+	}
+
+	return result, rows.Err()
+}
+
+func (c *SQLStore) GetDeletedTokens(before time.Time) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	rows, err := c.DB.QueryContext(ctx, c.rebind("SELECT "+sqlTokenColumns+" FROM tokens WHERE deleted_at <= ?"), toMillis(before))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]*Token, 0)
+
+	for rows.Next() {
+		token, err := scanToken(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, token)
+	}
+
+	return result, rows.Err()
+}
+
+func (c *SQLStore) GetApplicationsByUser(user string, query *ListQuery) ([]*Application, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	conditions, args := sqlListConditions(query, user)
+
+	rows, err := c.DB.QueryContext(ctx, c.rebind("SELECT "+sqlApplicationColumns+" FROM applications WHERE user_id = ? AND deleted_at IS NULL"+conditions), args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]*Application, 0)
+
+	for rows.Next() {
+		application, err := scanApplication(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, application)
+	}
+
+	return result, rows.Err()
+}
+
+func (c *SQLStore) GetTokensByApplication(application string, query *ListQuery) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	conditions, args := sqlListConditions(query, application)
+
+	rows, err := c.DB.QueryContext(ctx, c.rebind("SELECT "+sqlTokenColumns+" FROM tokens WHERE application = ? AND deleted_at IS NULL"+conditions), args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	result := make([]*Token, 0)
+
+	for rows.Next() {
+		token, err := scanToken(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, token)
+	}
+
+	return result, rows.Err()
+}
+
+func (c *SQLStore) GetRequestLogBuckets(query *UsageQuery) ([]*RequestLogBucket, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+
+	defer cancel()
+
+	var (
+		statement = "SELECT id, application, token, timestamp, request_count FROM request_log WHERE application = ? AND timestamp >= ? AND timestamp < ?"
+		args      = []interface{}{query.Application, toMillis(query.From), toMillis(query.To)}
+	)
+
+	if len(query.Token) > 0 {
+		statement += " AND token = ?"
+		args = append(args, query.Token)
+	}
+
+	rows, err := c.DB.QueryContext(ctx, c.rebind(statement), args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	entries := make([]RequestLog, 0)
+
+	for rows.Next() {
+		entry, err := scanRequestLog(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, *entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return BucketRequestLogs(query, entries), nil
+}
+
+func (c *SQLStore) SumRequestLogs(application string, from, to time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+
+	defer cancel()
+
+	var result int64
+
+	err := c.DB.QueryRowContext(
+		ctx,
+		c.rebind("SELECT COALESCE(SUM(request_count), 0) FROM request_log WHERE application = ? AND timestamp >= ? AND timestamp < ?"),
+		application, toMillis(from), toMillis(to),
+	).Scan(&result)
+
+	return result, err
+}
+
+func (c *SQLStore) IterateRequestLogExport(query *UsageQuery, group string, fn func(*RequestLogBucket) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+
+	defer cancel()
+
+	var (
+		where = "WHERE application = ? AND timestamp >= ? AND timestamp < ?"
+		args  = []interface{}{query.Application, toMillis(query.From), toMillis(query.To)}
+	)
+
+	if group == "token" {
+		rows, err := c.DB.QueryContext(ctx, c.rebind("SELECT token, SUM(request_count) FROM request_log "+where+" GROUP BY token ORDER BY token"), args...)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var result RequestLogBucket
+
+			if err := rows.Scan(&result.Token, &result.RequestCount); err != nil {
+				return err
+			}
+
+			if err := fn(&result); err != nil {
+				return err
+			}
+		}
+
+		return rows.Err()
+	}
+
+	rows, err := c.DB.QueryContext(ctx, c.rebind("SELECT id, application, token, timestamp, request_count FROM request_log "+where+" ORDER BY timestamp, token"), args...)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	// Rows are ordered by time, so each interval is complete as soon as a row from a later interval is read.
+	var current *RequestLogBucket
+
+	for rows.Next() {
+		entry, err := scanRequestLog(rows)
+
+		if err != nil {
+			return err
+		}
+
+		if group != "interval" {
+			if err := fn(&RequestLogBucket{Token: entry.Token, Timestamp: entry.Timestamp, RequestCount: entry.RequestCount}); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		timestamp := TruncateUsageTime(entry.Timestamp, query.Interval, query.Location).UTC()
+
+		if current != nil && !current.Timestamp.Equal(timestamp) {
+			if err := fn(current); err != nil {
+				return err
+			}
+
+			current = nil
+		}
+
+		if current == nil {
+			current = &RequestLogBucket{Timestamp: timestamp}
+		}
+
+		current.RequestCount += entry.RequestCount
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if current != nil {
+		return fn(current)
+	}
+
+	return nil
+}
+
+func (c *SQLStore) UpsertNotificationPreferences(document NotificationPreferences) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.DB.ExecContext(
+		ctx,
+		c.rebind(`INSERT INTO notification_preferences (application, email, webhook_url, webhook_secret, quota_alerts, spike_alerts) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (application) DO UPDATE SET email = excluded.email, webhook_url = excluded.webhook_url, webhook_secret = excluded.webhook_secret,
+			quota_alerts = excluded.quota_alerts, spike_alerts = excluded.spike_alerts`),
+		document.Application, document.Email, document.WebhookURL, document.WebhookSecret, document.QuotaAlerts, document.SpikeAlerts,
+	)
+
+	return err
+}
+
+func (c *SQLStore) UpdateWebhookDeliveryByID(id string, fields Fields) error {
+	return c.updateByID("webhook_deliveries", id, fields)
+}
+
+func (c *SQLStore) UpdateUserByID(id string, fields Fields) error {
+	return c.updateByID("users", id, fields)
+}
+
+func (c *SQLStore) UpdateSessionByID(id string, fields Fields) error {
+	return c.updateByID("sessions", id, fields)
+}
+
+func (c *SQLStore) UpdateApplicationByID(id string, fields Fields) error {
+	return c.updateByID("applications", id, fields)
+}
+
+func (c *SQLStore) UpdateTokenByID(id string, fields Fields) error {
+	return c.updateByID("tokens", id, fields)
+}
+
+func (c *SQLStore) DeleteSessionByID(id string) error {
+	return c.deleteByID("sessions", id)
+}
+
+func (c *SQLStore) DeleteSessionByPublicID(user, publicID string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	result, err := c.DB.ExecContext(ctx, c.rebind("DELETE FROM sessions WHERE user_id = ? AND public_id = ?"), user, publicID)
+
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := result.RowsAffected()
+
+	return deleted > 0, err
+}
+
+func (c *SQLStore) DeleteSessionsByUser(user, exceptID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	result, err := c.DB.ExecContext(ctx, c.rebind("DELETE FROM sessions WHERE user_id = ? AND id <> ?"), user, exceptID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (c *SQLStore) DeleteUsageBatch(id string) error {
+	return c.deleteByID("usage_batches", id)
+}
+
+func (c *SQLStore) DeleteAlert(id string) error {
+	return c.deleteByID("alerts", id)
+}
+
+func (c *SQLStore) DeleteWebhookByID(id string) error {
+	return c.deleteByID("webhooks", id)
+}
+
+func (c *SQLStore) DeleteTokenByID(id string) error {
+	return c.deleteByID("tokens", id)
+}
+
+func (c *SQLStore) DeleteApplication(id string, purgeRequestLog bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	defer cancel()
+
+	tx, err := c.DB.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := c.deleteApplication(ctx, tx, id, purgeRequestLog); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (c *SQLStore) DeleteUser(id string, deletedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	tx, err := c.DB.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, c.rebind("UPDATE applications SET deleted_at = ? WHERE user_id = ? AND deleted_at IS NULL"), toMillis(deletedAt), id); err != nil {
+		return err
+	}
+
+	for _, statement := range []string{"DELETE FROM sessions WHERE user_id = ?", "DELETE FROM users WHERE id = ?"} {
+		if _, err := tx.ExecContext(ctx, c.rebind(statement), id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (c *SQLStore) Close() error {
+	return c.DB.Close()
+}
+
+// deleteApplication removes the application and the rows that belong to it within the transaction.
+func (c *SQLStore) deleteApplication(ctx context.Context, tx *sql.Tx, id string, purgeRequestLog bool) error {
+	statements := []string{
+		"DELETE FROM tokens WHERE application = ?",
+		"DELETE FROM webhook_deliveries WHERE application = ?",
+		"DELETE FROM webhooks WHERE application = ?",
+		"DELETE FROM notification_preferences WHERE application = ?",
+		"DELETE FROM alerts WHERE application = ?",
+	}
+
+	if purgeRequestLog {
+		statements = append(statements, "DELETE FROM request_log WHERE application = ?")
+	}
+
+	for _, statement := range append(statements, "DELETE FROM applications WHERE id = ?") {
+		if _, err := tx.ExecContext(ctx, c.rebind(statement), id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *SQLStore) updateByID(table, id string, fields Fields) error {
+	if len(fields) < 1 {
+		return nil
+	}
+
+	var (
+		assignments = make([]string, 0, len(fields))
+		args        = make([]interface{}, 0, len(fields)+1)
+	)
+
+	for field, value := range fields {
+		assignments = append(assignments, sqlColumnName(field)+" = ?")
+		args = append(args, toSQLValue(value))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.DB.ExecContext(ctx, c.rebind("UPDATE "+table+" SET "+strings.Join(assignments, ", ")+" WHERE id = ?"), append(args, id)...)
+
+	return err
+}
+
+func (c *SQLStore) deleteByID(table, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+
+	defer cancel()
+
+	_, err := c.DB.ExecContext(ctx, c.rebind("DELETE FROM "+table+" WHERE id = ?"), id)
+
+	return err
+}
+
+// rebind replaces the ? placeholders in the query with the numbered placeholders used by PostgreSQL.
+func (c *SQLStore) rebind(query string) string {
+	if c.Driver != "postgres" {
+		return query
+	}
+
+	var (
+		result strings.Builder
+		index  = 0
+	)
+
+	for _, char := range query {
+		if char != '?' {
+			result.WriteRune(char)
+
+			continue
+		}
+
+		index++
+
+		result.WriteString("$" + strconv.Itoa(index))
+	}
+
+	return result.String()
+}
+
+// wrapError converts unique constraint violations into ErrDuplicateKey.
+func (c *SQLStore) wrapError(err error) error {
+	var (
+		pqError     *pq.Error
+		sqliteError *sqlite.Error
+	)
+
+	if errors.As(err, &pqError) && pqError.Code == "23505" {
+		return ErrDuplicateKey
+	}
+
+	if errors.As(err, &sqliteError) && (sqliteError.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteError.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY) {
+		return ErrDuplicateKey
+	}
+
+	return err
+}
+
+// MigrateSQLStore connects to the SQL database at the URI and migrates its schema up or down to the version.
+func MigrateSQLStore(uri string, version int) error {
+	if version > LatestSQLMigration() {
+		return fmt.Errorf("unknown migration version: %d", version)
+	}
+
+	db := &SQLStore{}
+
+	if err := db.Connect(uri); err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	return db.Migrate(version)
+}
+
+func scanUser(row sqlRow) (*User, error) {
+	var (
+		result    User
+		createdAt int64
+	)
+
+	if err := row.Scan(&result.ID, &result.Email, &result.Password, &result.Type, &createdAt); err != nil {
+		return nil, err
+	}
+
+	result.CreatedAt = fromMillis(createdAt)
+
+	return &result, nil
+}
+
+func scanSession(row sqlRow) (*Session, error) {
+	var (
+		result     Session
+		createdAt  int64
+		lastUsedAt int64
+		expiresAt  sql.NullInt64
+	)
+
+	if err := row.Scan(&result.ID, &result.PublicID, &result.User, &result.IP, &result.UserAgent, &createdAt, &lastUsedAt, &expiresAt); err != nil {
+		return nil, err
+	}
+
+	result.CreatedAt = fromMillis(createdAt)
+	result.LastUsedAt = fromMillis(lastUsedAt)
+	result.ExpiresAt = fromNullMillis(expiresAt)
+
+	return &result, nil
+}
+
+func scanApplication(row sqlRow) (*Application, error) {
+	var (
+		result       Application
+		requestCount int64
+		createdAt    int64
+		deletedAt    sql.NullInt64
+	)
+
+	if err := row.Scan(&result.ID, &result.Name, &result.ShortDescription, &result.User, &result.TokenPrefix, &result.TokenHash, &result.Plan, &requestCount, &createdAt, &deletedAt); err != nil {
+		return nil, err
+	}
+
+	result.RequestCount = uint64(requestCount)
+	result.CreatedAt = fromMillis(createdAt)
+	result.DeletedAt = fromNullMillis(deletedAt)
+
+	return &result, nil
+}
+
+func scanToken(row sqlRow) (*Token, error) {
+	var (
+		result                  Token
+		requestCount            int64
+		createdAt               int64
+		lastUsedAt              sql.NullInt64
+		deletedAt               sql.NullInt64
+		previousSecretExpiresAt sql.NullInt64
+		expiresAt               sql.NullInt64
+		scopes                  string
+		allowedCIDRs            string
+		allowedReferrers        string
+	)
+
+	if err := row.Scan(&result.ID, &result.Name, &result.Prefix, &result.Hash, &requestCount, &result.Application, &createdAt, &lastUsedAt, &deletedAt, &result.PreviousSecretHash, &previousSecretExpiresAt, &expiresAt, &scopes, &allowedCIDRs, &allowedReferrers, &result.Disabled); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(scopes), &result.Scopes); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(allowedCIDRs), &result.AllowedCIDRs); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(allowedReferrers), &result.AllowedReferrers); err != nil {
+		return nil, err
+	}
+
+	result.RequestCount = uint64(requestCount)
+	result.CreatedAt = fromMillis(createdAt)
+	result.LastUsedAt = fromNullMillis(lastUsedAt)
+	result.DeletedAt = fromNullMillis(deletedAt)
+	result.PreviousSecretExpiresAt = fromNullMillis(previousSecretExpiresAt)
+	result.ExpiresAt = fromNullMillis(expiresAt)
+
+	return &result, nil
+}
+
+func scanRequestLog(row sqlRow) (*RequestLog, error) {
+	var (
+		result    RequestLog
+		timestamp int64
+	)
+
+	if err := row.Scan(&result.ID, &result.Application, &result.Token, &timestamp, &result.RequestCount); err != nil {
+		return nil, err
+	}
+
+	result.Timestamp = fromMillis(timestamp)
+
+	return &result, nil
+}
+
+func scanWebhook(row sqlRow) (*Webhook, error) {
+	var (
+		result    Webhook
+		events    string
+		createdAt int64
+	)
+
+	if err := row.Scan(&result.ID, &result.Application, &result.URL, &result.Secret, &events, &createdAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(events), &result.Events); err != nil {
+		return nil, err
+	}
+
+	result.CreatedAt = fromMillis(createdAt)
+
+	return &result, nil
+}
+
+func scanDelivery(row sqlRow) (*WebhookDelivery, error) {
+	var (
+		result        WebhookDelivery
+		nextAttemptAt int64
+		lockedUntil   sql.NullInt64
+		createdAt     int64
+		deliveredAt   sql.NullInt64
+	)
+
+	if err := row.Scan(
+		&result.ID, &result.Webhook, &result.Application, &result.Event, &result.URL, &result.Payload, &result.Status, &result.Attempts,
+		&nextAttemptAt, &lockedUntil, &result.LastError, &result.ResponseStatus, &createdAt, &deliveredAt,
+	); err != nil {
+		return nil, err
+	}
+
+	result.NextAttemptAt = fromMillis(nextAttemptAt)
+	result.LockedUntil = fromNullMillis(lockedUntil)
+	result.CreatedAt = fromMillis(createdAt)
+	result.DeliveredAt = fromNullMillis(deliveredAt)
+
+	return &result, nil
+}
+
+// nilIfNoRows returns nil without an error if the row was not found, matching the behavior of the other stores.
+func nilIfNoRows[T any](value *T, err error) (*T, error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// sqlOrderBy returns the ORDER BY expression for the column, sorting null values first in ascending order
+// and last in descending order like MongoDB does.
+func sqlOrderBy(column, direction string, nullable bool) string {
+	order := "DESC"
+
+	if GetSortDirectionValue(direction) > 0 {
+		order = "ASC"
+	}
+
+	if nullable {
+		return fmt.Sprintf("(%s IS NOT NULL) %s, %s %s", column, order, column, order)
+	}
+
+	return fmt.Sprintf("%s %s", column, order)
+}
+
+// sqlListConditions returns the conditions, ORDER BY and LIMIT clauses that filter, sort and limit a list of
+// applications or tokens, along with their arguments appended to args. Null values are sorted first, the same
+// as in MongoDB.
+func sqlListConditions(query *ListQuery, args ...interface{}) (string, []interface{}) {
+	var (
+		result   strings.Builder
+		column   = sqlColumnName(query.Sort)
+		nullable = query.Sort == "lastUsedAt"
+	)
+
+	if len(query.Search) > 0 {
+		result.WriteString(" AND LOWER(name) LIKE ? ESCAPE '\\'")
+		args = append(args, "%"+sqlLikeReplacer.Replace(strings.ToLower(query.Search))+"%")
+	}
+
+	if query.CreatedAfter != nil {
+		result.WriteString(" AND created_at > ?")
+		args = append(args, toMillis(*query.CreatedAfter))
+	}
+
+	if query.CreatedBefore != nil {
+		result.WriteString(" AND created_at < ?")
+		args = append(args, toMillis(*query.CreatedBefore))
+	}
+
+	if query.Cursor != nil {
+		comparison := ">"
+
+		if query.Direction == "descending" {
+			comparison = "<"
+		}
+
+		switch {
+		case query.Cursor.Value == nil && comparison == ">":
+			result.WriteString(fmt.Sprintf(" AND ((%s IS NULL AND id > ?) OR %s IS NOT NULL)", column, column))
+			args = append(args, query.Cursor.ID)
+		case query.Cursor.Value == nil:
+			result.WriteString(fmt.Sprintf(" AND %s IS NULL AND id > ?", column))
+			args = append(args, query.Cursor.ID)
+		default:
+			value := toSQLValue(query.Cursor.Value)
+
+			if comparison == "<" && nullable {
+				result.WriteString(fmt.Sprintf(" AND (%s < ? OR (%s = ? AND id > ?) OR %s IS NULL)", column, column, column))
+			} else {
+				result.WriteString(fmt.Sprintf(" AND (%s %s ? OR (%s = ? AND id > ?))", column, comparison, column))
+			}
+
+			args = append(args, value, value, query.Cursor.ID)
+		}
+	}
+
+	result.WriteString(" ORDER BY " + sqlOrderBy(column, query.Direction, nullable) + ", id")
+
+	if query.Limit > 0 {
+		result.WriteString(" LIMIT ?")
+		args = append(args, query.Limit)
+	}
+
+	return result.String(), args
+}
+
+// sqlColumnName converts the name of a document field to the name of its column.
+func sqlColumnName(field string) string {
+	if field == "user" {
+		return "user_id"
+	}
+
+	var result strings.Builder
+
+	for _, char := range field {
+		if unicode.IsUpper(char) {
+			result.WriteRune('_')
+			char = unicode.ToLower(char)
+		}
+
+		result.WriteRune(char)
+	}
+
+	return result.String()
+}
+
+func toSQLValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return toMillis(v)
+	case *time.Time:
+		return toNullMillis(v)
+	case []string:
+		data, _ := json.Marshal(v)
+
+		return string(data)
+	default:
+		return v
+	}
+}
+
+func toMillis(value time.Time) int64 {
+	return value.UnixMilli()
+}
+
+func toNullMillis(value *time.Time) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	return value.UnixMilli()
+}
+
+func fromMillis(value int64) time.Time {
+	return time.UnixMilli(value).UTC()
+}
+
+func fromNullMillis(value sql.NullInt64) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+
+	result := fromMillis(value.Int64)
+
+	return &result
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrDuplicateKey is returned by a store when inserting a document whose ID or unique field already exists.
+	ErrDuplicateKey error = errors.New("store: duplicate key")
+	// ErrUsageBatchIncomplete is returned by a store that failed to apply every write of a usage batch at once.
+	// The writes that did complete are recorded on the batch, which must be kept so that a retry skips them.
+	ErrUsageBatchIncomplete error = errors.New("store: usage batch incomplete")
+)
+
+// Fields are the values to set on a document when updating it, keyed by the name of the field as it is stored.
+type Fields map[string]interface{}
+
+// Store is the storage backend used by the handlers and background workers. Methods that look up a single
+// document return nil without an error when it does not exist. Soft deleted applications and tokens are
+// only left out of lists, so callers that look them up directly must check whether they are deleted.
+type Store interface {
+	InsertUser(document User) error
+	InsertSession(document Session) error
+	InsertApplication(document Application) error
+	InsertToken(document Token) error
+	InsertUsageBatch(id string) (bool, error)
+	InsertWebhook(document Webhook) error
+	InsertWebhookDeliveries(documents []WebhookDelivery) error
+	InsertAlert(id, application string, expiresAt time.Time) (bool, error)
+	IncrementUsage(batchID string, increments []*UsageIncrement) error
+	GetUserByEmail(email string) (*User, error)
+	GetUserByID(id string) (*User, error)
+	GetSessionByID(id string) (*Session, error)
+	GetSessionsByUser(user string) ([]*Session, error)
+	GetTokenByID(id string) (*Token, error)
+	GetTokenByHash(hash string) (*Token, error)
+	GetTokenByApplicationAndID(application, id string) (*Token, error)
+	GetApplicationByID(id string) (*Application, error)
+	IterateApplications(fn func(*Application) error) error
+	GetNotificationPreferences(application string) (*NotificationPreferences, error)
+	GetWebhookByID(id string) (*Webhook, error)
+	GetWebhookByApplicationAndID(application, id string) (*Webhook, error)
+	GetWebhooksByApplication(application string) ([]*Webhook, error)
+	GetWebhookDeliveriesByWebhook(webhook string, limit int64) ([]*WebhookDelivery, error)
+	ClaimWebhookDelivery(now, lockedUntil time.Time) (*WebhookDelivery, error)
+	GetDeletedApplications(before time.Time) ([]*Application, error)
+	GetDeletedTokens(before time.Time) ([]*Token, error)
+	GetApplicationsByUser(user string, query *ListQuery) ([]*Application, error)
+	GetTokensByApplication(application string, query *ListQuery) ([]*Token, error)
+	GetRequestLogBuckets(query *UsageQuery) ([]*RequestLogBucket, error)
+	SumRequestLogs(application string, from, to time.Time) (int64, error)
+	IterateRequestLogExport(query *UsageQuery, group string, fn func(*RequestLogBucket) error) error
+	UpsertNotificationPreferences(document NotificationPreferences) error
+	UpdateWebhookDeliveryByID(id string, fields Fields) error
+	UpdateUserByID(id string, fields Fields) error
+	UpdateSessionByID(id string, fields Fields) error
+	UpdateApplicationByID(id string, fields Fields) error
+	UpdateTokenByID(id string, fields Fields) error
+	DeleteSessionByID(id string) error
+	DeleteSessionByPublicID(user, publicID string) (bool, error)
+	DeleteSessionsByUser(user, exceptID string) (int64, error)
+	DeleteUsageBatch(id string) error
+	DeleteAlert(id string) error
+	DeleteWebhookByID(id string) error
+	DeleteTokenByID(id string) error
+	DeleteApplication(id string, purgeRequestLog bool) error
+	DeleteUser(id string, deletedAt time.Time) error
+	Close() error
+}
+
+// NewStore connects to the storage backend, preparing it for use. If the name is empty, the backend is
+// chosen from the scheme of the database URI.
+func NewStore(name, uri string) (Store, error) {
+	if len(name) < 1 {
+		name = GetStoreName(uri)
+	}
+
+	switch name {
+	case "memory":
+		log.Println("Using the in-memory store, data will be lost when the process exits")
+
+		return NewMemoryStore(), nil
+	case "mongodb":
+		db := &MongoDB{}
+
+		if err := db.Connect(uri); err != nil {
+			return nil, err
+		}
+
+		log.Println("Successfully connected to MongoDB")
+
+		// Tokens are migrated before the indexes are reconciled, so that tokens stored in plaintext are hashed
+		// by the time the unique index on token hashes is built.
+		if migrated, err := db.MigratePlaintextTokens(); err != nil {
+			return nil, err
+		} else if migrated > 0 {
+			log.Printf("Migrated %d plaintext tokens to hashed tokens\n", migrated)
+		}
+
+		if migrated, err := db.MigrateTokenScopes(); err != nil {
+			return nil, err
+		} else if migrated > 0 {
+			log.Printf("Gave the default scopes to %d tokens created before scopes existed\n", migrated)
+		}
+
+		if _, err := db.ReconcileIndexes(true); err != nil {
+			return nil, err
+		}
+
+		return db, nil
+	case "postgres", "sqlite":
+		db := &SQLStore{}
+
+		if err := db.Connect(uri); err != nil {
+			return nil, err
+		}
+
+		log.Printf("Successfully connected to %s\n", name)
+
+		if err := db.Migrate(LatestSQLMigration()); err != nil {
+			return nil, err
+		}
+
+		return db, nil
+	default:
+		return nil, fmt.Errorf("unknown store: %s", name)
+	}
+}
+
+// GetStoreName returns the name of the storage backend for the scheme of the database URI.
+func GetStoreName(uri string) string {
+	switch strings.SplitN(uri, ":", 2)[0] {
+	case "mongodb", "mongodb+srv":
+		return "mongodb"
+	case "postgres", "postgresql":
+		return "postgres"
+	case "sqlite", "sqlite3":
+		return "sqlite"
+	default:
+		return ""
+	}
+}
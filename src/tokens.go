@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// TokenScopes is the list of scopes that tokens can be granted.
+	TokenScopes []string = []string{
+		"status:java",
+		"status:bedrock",
+		"icon:read",
+		"usage:read",
+	}
+	// DefaultTokenScopes are the scopes of tokens created without choosing any, which are also the scopes given
+	// to tokens that were created before scopes existed.
+	DefaultTokenScopes []string = []string{
+		"status:java",
+		"status:bedrock",
+		"icon:read",
+	}
+)
+
+// TokenRestrictions limit where a token can be used from. An empty list of CIDR ranges allows every IP address,
+// and an empty list of referrers allows every referrer, including none. Referrers are origins such as
+// https://example.com, or https://*.example.com to allow every subdomain. The IP address of a request is that
+// of the connection, unless it was sent by one of the trusted proxies in ProxyConfig.
+type TokenRestrictions struct {
+	AllowedCIDRs     []string `bson:"allowedCidrs" json:"allowedCidrs"`
+	AllowedReferrers []string `bson:"allowedReferrers" json:"allowedReferrers"`
+}
+
+// RotateToken issues a new secret for the token and returns it. The previous secret keeps working until the
+// rotation grace period has passed, so that clients can move over to the new secret without downtime. Rotating
+// a token again during the grace period stops the secret before the previous one from working right away.
+func RotateToken(store Store, token *Token) (string, error) {
+	secret, prefix := GenerateAPIToken()
+
+	var (
+		previousHash      = token.Hash
+		previousExpiresAt *time.Time
+	)
+
+	if config.Tokens.RotationGracePeriod > 0 {
+		previousExpiresAt = timePointer(time.Now().UTC().Add(config.Tokens.RotationGracePeriod))
+	} else {
+		previousHash = ""
+	}
+
+	fields := Fields{
+		"prefix":                  prefix,
+		"hash":                    HashAPIToken(secret),
+		"previousSecretHash":      previousHash,
+		"previousSecretExpiresAt": previousExpiresAt,
+	}
+
+	if err := store.UpdateTokenByID(token.ID, fields); err != nil {
+		return "", err
+	}
+
+	invalidateTokenCache(token)
+
+	token.Prefix = prefix
+	token.Hash = fields["hash"].(string)
+	token.PreviousSecretHash = previousHash
+	token.PreviousSecretExpiresAt = previousExpiresAt
+
+	EmitWebhookEvent(store, token.Application, "token.rotated", token)
+
+	return secret, nil
+}
+
+// UpdateToken changes the fields of the token and returns it as it is after the update. Cached introspection
+// results of the token are dropped, so that disabling it or changing its restrictions applies right away.
+func UpdateToken(store Store, token *Token, fields Fields) (*Token, error) {
+	if err := store.UpdateTokenByID(token.ID, fields); err != nil {
+		return nil, err
+	}
+
+	invalidateTokenCache(token)
+
+	result, err := store.GetTokenByID(token.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	EmitWebhookEvent(store, token.Application, "token.updated", result)
+
+	return result, nil
+}
+
+// ResolveTokenExpiry returns the expiry time of a new token of the application from the requested expiry time in
+// Unix milliseconds or time to live in seconds, only one of which may be given. If the plan of the application
+// limits the lifetime of tokens, tokens without a requested expiry expire at the end of it. The returned error
+// is safe to return to the user.
+func ResolveTokenExpiry(application *Application, expiresAt, ttl *int64, now time.Time) (*time.Time, error) {
+	var result *time.Time
+
+	switch {
+	case expiresAt != nil && ttl != nil:
+		return nil, errors.New("only one of expiresAt and ttl may be given")
+	case expiresAt != nil:
+		if result = timePointer(time.UnixMilli(*expiresAt).UTC()); !result.After(now) {
+			return nil, errors.New("expiresAt must be in the future")
+		}
+	case ttl != nil:
+		if *ttl < 1 || *ttl > int64(math.MaxInt64/time.Second) {
+			return nil, errors.New("ttl must be a positive number of seconds")
+		}
+
+		result = timePointer(now.Add(time.Duration(*ttl) * time.Second).UTC())
+	}
+
+	planName, plan := application.GetPlan()
+
+	if plan.MaxTokenLifetime <= 0 {
+		return result, nil
+	}
+
+	maxExpiresAt := now.Add(plan.MaxTokenLifetime).UTC()
+
+	if result == nil {
+		return &maxExpiresAt, nil
+	}
+
+	if result.After(maxExpiresAt) {
+		return nil, fmt.Errorf("tokens on the %s plan cannot be valid for longer than %s", planName, plan.MaxTokenLifetime)
+	}
+
+	return result, nil
+}
+
+// IsExpired returns whether the token has expired at the given time.
+func (t *Token) IsExpired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// IsTokenScope returns whether the scope is in the list of scopes that tokens can be granted.
+func IsTokenScope(scope string) bool {
+	return ContainsString(TokenScopes, scope)
+}
+
+// NormalizeTokenRestrictions validates the CIDR ranges and referrer origins and returns them in their canonical
+// form. A single IP address is treated as a range containing only that address. The returned error is safe to
+// return to the user.
+func NormalizeTokenRestrictions(cidrs, referrers []string) (TokenRestrictions, error) {
+	result := TokenRestrictions{
+		AllowedCIDRs:     make([]string, 0, len(cidrs)),
+		AllowedReferrers: make([]string, 0, len(referrers)),
+	}
+
+	for _, value := range cidrs {
+		prefix, err := parseCIDR(value)
+
+		if err != nil {
+			return result, fmt.Errorf("invalid CIDR range: %s", value)
+		}
+
+		result.AllowedCIDRs = append(result.AllowedCIDRs, prefix.String())
+	}
+
+	for _, value := range referrers {
+		origin, err := parseReferrerOrigin(value, true)
+
+		if err != nil {
+			return result, fmt.Errorf("invalid referrer, expected an origin such as https://example.com: %s", value)
+		}
+
+		result.AllowedReferrers = append(result.AllowedReferrers, origin)
+	}
+
+	return result, nil
+}
+
+// Allows returns nil if a request from the IP address with the Referer header may use the token, or an error
+// describing why it may not.
+func (r TokenRestrictions) Allows(ip, referer string) error {
+	if len(r.AllowedCIDRs) > 0 {
+		addr, err := netip.ParseAddr(ip)
+
+		if err != nil {
+			return errors.New("the IP address is not allowed to use this token")
+		}
+
+		allowed := false
+
+		for _, value := range r.AllowedCIDRs {
+			if prefix, err := netip.ParsePrefix(value); err == nil && prefix.Contains(addr.Unmap()) {
+				allowed = true
+
+				break
+			}
+		}
+
+		if !allowed {
+			return errors.New("the IP address is not allowed to use this token")
+		}
+	}
+
+	if len(r.AllowedReferrers) > 0 {
+		origin, err := parseReferrerOrigin(referer, false)
+
+		if err != nil {
+			return errors.New("the referrer is not allowed to use this token")
+		}
+
+		for _, value := range r.AllowedReferrers {
+			if value == origin {
+				return nil
+			}
+
+			// A wildcard origin such as https://*.example.com is split into the scheme and the parent domain.
+			if parts := strings.SplitN(value, "://*.", 2); len(parts) == 2 && strings.HasPrefix(origin, parts[0]+"://") && strings.HasSuffix(origin, "."+parts[1]) {
+				return nil
+			}
+		}
+
+		return errors.New("the referrer is not allowed to use this token")
+	}
+
+	return nil
+}
+
+func parseCIDR(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		addr = addr.Unmap()
+
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return prefix.Masked(), nil
+}
+
+// parseReferrerOrigin returns the origin of the referrer URL. Allowed referrers must be bare origins, and may
+// start their host with a wildcard label if wildcard is true.
+func parseReferrerOrigin(value string, wildcard bool) (string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(value))
+
+	if err != nil {
+		return "", err
+	}
+
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Hostname()) < 1 || parsed.User != nil {
+		return "", errors.New("referrer is not an HTTP URL")
+	}
+
+	host := strings.ToLower(parsed.Host)
+
+	if wildcard {
+		if (len(parsed.Path) > 0 && parsed.Path != "/") || len(parsed.RawQuery) > 0 || len(parsed.Fragment) > 0 {
+			return "", errors.New("referrer is not an origin")
+		}
+
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return "", errors.New("referrer has a wildcard that is not the first label")
+		}
+	}
+
+	return parsed.Scheme + "://" + host, nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	// UsageChartInterval is the interval that request log entries are bucketed to when they are stored.
+	UsageChartInterval time.Duration = time.Hour
+	// UsageIntervalMaxRanges is the longest date range that can be requested for each usage interval. There is
+	// no interval shorter than UsageChartInterval, since usage is not stored at a finer granularity.
+	UsageIntervalMaxRanges map[string]time.Duration = map[string]time.Duration{
+		"hour":  time.Hour * 24 * 31,
+		"day":   time.Hour * 24 * 366,
+		"week":  time.Hour * 24 * 366 * 2,
+		"month": time.Hour * 24 * 366 * 10,
+	}
+	// UsageBatchLease is how long a claimed usage batch is reserved for the request that claimed it. A batch that
+	// has not been applied by then, such as when the server stopped while applying it, can be claimed again.
+	UsageBatchLease time.Duration = time.Minute * 5
+	// UsageBatchHistory is how many of the most recent batches are recorded on each document that usage batches
+	// increment in MongoDB. A failed batch is retried soon after, so only recent batches need to be recorded.
+	UsageBatchHistory int = 100
+)
+
+// UsageEvent is a number of requests made with a token at a point in time, as reported by another service.
+type UsageEvent struct {
+	Token     string `json:"token" validate:"required"`
+	Timestamp int64  `json:"timestamp" validate:"required"`
+	Count     int64  `json:"count" validate:"min=1"`
+}
+
+// UsageIncrement is the number of requests to add to a single request log bucket.
+type UsageIncrement struct {
+	Application  string
+	Token        string
+	Timestamp    time.Time
+	LastUsedAt   time.Time
+	RequestCount int64
+}
+
+// UsageQuery selects the request log entries to aggregate and how to bucket them.
+type UsageQuery struct {
+	Application  string
+	Token        string
+	GroupByToken bool
+	From         time.Time
+	To           time.Time
+	Interval     string
+	Location     *time.Location
+}
+
+// UsageLogResponseBody is a single bucket of a usage chart.
+type UsageLogResponseBody struct {
+	Timestamp    string `json:"timestamp"`
+	RequestCount int64  `json:"requestCount"`
+}
+
+// TokenUsageResponseBody is the usage chart of a single token.
+type TokenUsageResponseBody struct {
+	Token string                  `json:"token"`
+	Name  string                  `json:"name"`
+	Usage []*UsageLogResponseBody `json:"usage"`
+}
+
+// UsageIngestResult is the outcome of ingesting a batch of usage events.
+type UsageIngestResult struct {
+	Accepted  int  `json:"accepted"`
+	Rejected  int  `json:"rejected"`
+	Duplicate bool `json:"duplicate"`
+}
+
+// IngestUsageBatch buckets the usage events into the request log and updates the request counters of the
+// tokens and applications. Each batch ID is only ever applied once, so a batch can be safely retried. If the
+// writes fail, the sender can retry the batch, which only applies the writes that did not complete. A retry of a
+// batch that is still being applied is a duplicate until the lease of the first attempt runs out.
+func IngestUsageBatch(store Store, batchID string, events []UsageEvent) (*UsageIngestResult, error) {
+	var (
+		err        error
+		result     = &UsageIngestResult{}
+		tokens     = make(map[string]*Token)
+		increments = make(map[[2]string]*UsageIncrement)
+		maxTime    = time.Now().Add(time.Minute * 5)
+	)
+
+	for _, event := range events {
+		timestamp := time.UnixMilli(event.Timestamp).UTC()
+
+		if timestamp.After(maxTime) {
+			result.Rejected++
+
+			continue
+		}
+
+		token, ok := tokens[event.Token]
+
+		if !ok {
+			if token, err = store.GetTokenByID(event.Token); err != nil {
+				return nil, err
+			}
+
+			tokens[event.Token] = token
+		}
+
+		if token == nil {
+			result.Rejected++
+
+			continue
+		}
+
+		bucket := timestamp.Truncate(UsageChartInterval)
+		key := [2]string{token.ID, bucket.Format(time.RFC3339)}
+
+		increment, ok := increments[key]
+
+		if !ok {
+			increment = &UsageIncrement{
+				Application: token.Application,
+				Token:       token.ID,
+				Timestamp:   bucket,
+			}
+
+			increments[key] = increment
+		}
+
+		increment.RequestCount += event.Count
+
+		if timestamp.After(increment.LastUsedAt) {
+			increment.LastUsedAt = timestamp
+		}
+
+		result.Accepted++
+	}
+
+	values := make([]*UsageIncrement, 0, len(increments))
+
+	for _, increment := range increments {
+		values = append(values, increment)
+	}
+
+	claimed, err := store.InsertUsageBatch(batchID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !claimed {
+		return &UsageIngestResult{Duplicate: true}, nil
+	}
+
+	if err := store.IncrementUsage(batchID, values); err != nil {
+		// None of the writes were applied unless the store kept track of the ones that were, so the batch is
+		// released to let the sender retry it from the start.
+		if !errors.Is(err, ErrUsageBatchIncomplete) {
+			_ = store.DeleteUsageBatch(batchID)
+		}
+
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ParseUsageQuery parses the from, to, interval and tz query parameters of a usage request. The returned
+// error describes the invalid parameter and is safe to return to the user.
+func ParseUsageQuery(ctx *fiber.Ctx) (*UsageQuery, error) {
+	var (
+		now   = time.Now()
+		query = &UsageQuery{
+			Interval: ctx.Query("interval", "hour"),
+		}
+	)
+
+	switch groupBy := ctx.Query("groupBy"); groupBy {
+	case "":
+		break
+	case "token":
+		query.GroupByToken = true
+	default:
+		return nil, fmt.Errorf("invalid groupBy: %s", groupBy)
+	}
+
+	maxRange, ok := UsageIntervalMaxRanges[query.Interval]
+
+	if !ok {
+		return nil, fmt.Errorf("invalid interval: %s", query.Interval)
+	}
+
+	timezone := ctx.Query("tz", "UTC")
+
+	if timezone == "Local" {
+		return nil, fmt.Errorf("invalid timezone: %s", timezone)
+	}
+
+	location, err := time.LoadLocation(timezone)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %s", timezone)
+	}
+
+	query.Location = location
+
+	if query.From, err = parseUsageTime(ctx.Query("from"), now.Add(-time.Hour*24)); err != nil {
+		return nil, errors.New("invalid from value, expected a Unix timestamp in milliseconds")
+	}
+
+	if query.To, err = parseUsageTime(ctx.Query("to"), now); err != nil {
+		return nil, errors.New("invalid to value, expected a Unix timestamp in milliseconds")
+	}
+
+	if !query.From.Before(query.To) {
+		return nil, errors.New("from must be before to")
+	}
+
+	if query.To.Sub(query.From) > maxRange {
+		return nil, fmt.Errorf("date range is too large for the %s interval, the maximum is %s", query.Interval, maxRange)
+	}
+
+	query.From = TruncateUsageTime(query.From, query.Interval, query.Location)
+
+	return query, nil
+}
+
+// FillUsageBuckets returns a bucket for every interval in the query range, using zero for intervals without any requests.
+func FillUsageBuckets(query *UsageQuery, buckets []*RequestLogBucket) []*UsageLogResponseBody {
+	var (
+		counts      = make(map[int64]int64)
+		result      = make([]*UsageLogResponseBody, 0)
+		currentDate = query.From
+	)
+
+	for _, bucket := range buckets {
+		counts[bucket.Timestamp.UnixMilli()] += bucket.RequestCount
+	}
+
+	for currentDate.Before(query.To) {
+		result = append(result, &UsageLogResponseBody{
+			Timestamp:    currentDate.Format(time.RFC3339),
+			RequestCount: counts[currentDate.UnixMilli()],
+		})
+
+		currentDate = NextUsageTime(currentDate, query.Interval)
+	}
+
+	return result
+}
+
+// GroupUsageBucketsByToken returns a usage chart for each of the tokens, followed by any other tokens that
+// appear in the buckets, such as tokens that have since been deleted.
+func GroupUsageBucketsByToken(query *UsageQuery, tokens []*Token, buckets []*RequestLogBucket) []*TokenUsageResponseBody {
+	var (
+		result  = make([]*TokenUsageResponseBody, 0, len(tokens))
+		grouped = make(map[string][]*RequestLogBucket)
+		order   = make([]string, 0)
+	)
+
+	for _, bucket := range buckets {
+		if _, ok := grouped[bucket.Token]; !ok {
+			order = append(order, bucket.Token)
+		}
+
+		grouped[bucket.Token] = append(grouped[bucket.Token], bucket)
+	}
+
+	for _, token := range tokens {
+		result = append(result, &TokenUsageResponseBody{
+			Token: token.ID,
+			Name:  token.Name,
+			Usage: FillUsageBuckets(query, grouped[token.ID]),
+		})
+
+		delete(grouped, token.ID)
+	}
+
+	for _, token := range order {
+		tokenBuckets, ok := grouped[token]
+
+		if !ok {
+			continue
+		}
+
+		result = append(result, &TokenUsageResponseBody{
+			Token: token,
+			Usage: FillUsageBuckets(query, tokenBuckets),
+		})
+	}
+
+	return result
+}
+
+// BucketRequestLogs aggregates the request log entries into the buckets of the usage query, for stores that
+// cannot aggregate them in the database. The entries must already be filtered by the query.
+func BucketRequestLogs(query *UsageQuery, entries []RequestLog) []*RequestLogBucket {
+	var (
+		buckets = make(map[string]*RequestLogBucket)
+		result  = make([]*RequestLogBucket, 0)
+	)
+
+	for _, entry := range entries {
+		bucket := RequestLogBucket{
+			Timestamp: TruncateUsageTime(entry.Timestamp, query.Interval, query.Location).UTC(),
+		}
+
+		if query.GroupByToken {
+			bucket.Token = entry.Token
+		}
+
+		key := bucket.Token + ":" + bucket.Timestamp.Format(time.RFC3339)
+
+		if _, ok := buckets[key]; !ok {
+			buckets[key] = &bucket
+
+			result = append(result, &bucket)
+		}
+
+		buckets[key].RequestCount += entry.RequestCount
+	}
+
+	sortRequestLogBuckets(result)
+
+	return result
+}
+
+// TruncateUsageTime returns the start of the interval containing the time, in the given location. Weeks start on Monday.
+func TruncateUsageTime(value time.Time, interval string, location *time.Location) time.Time {
+	value = value.In(location)
+
+	switch interval {
+	case "hour":
+		return time.Date(value.Year(), value.Month(), value.Day(), value.Hour(), 0, 0, 0, location)
+	case "day":
+		return time.Date(value.Year(), value.Month(), value.Day(), 0, 0, 0, 0, location)
+	case "week":
+		return time.Date(value.Year(), value.Month(), value.Day()-(int(value.Weekday())+6)%7, 0, 0, 0, 0, location)
+	case "month":
+		return time.Date(value.Year(), value.Month(), 1, 0, 0, 0, 0, location)
+	default:
+		return value
+	}
+}
+
+// NextUsageTime returns the start of the interval following the one that starts at the time.
+func NextUsageTime(value time.Time, interval string) time.Time {
+	switch interval {
+	case "hour":
+		return value.Add(time.Hour)
+	case "day":
+		return value.AddDate(0, 0, 1)
+	case "week":
+		return value.AddDate(0, 0, 7)
+	case "month":
+		return value.AddDate(0, 1, 0)
+	default:
+		return value.Add(UsageChartInterval)
+	}
+}
+
+func parseUsageTime(value string, defaultValue time.Time) (time.Time, error) {
+	if len(value) < 1 {
+		return defaultValue, nil
+	}
+
+	result, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.UnixMilli(result), nil
+}
+
+func sortRequestLogBuckets(buckets []*RequestLogBucket) {
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if !buckets[i].Timestamp.Equal(buckets[j].Timestamp) {
+			return buckets[i].Timestamp.Before(buckets[j].Timestamp)
+		}
+
+		return buckets[i].Token < buckets[j].Token
+	})
+}
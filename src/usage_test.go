@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// failingUsageStore fails to increment usage with the error, as a store would when its writes fail.
+type failingUsageStore struct {
+	*MemoryStore
+	Err error
+}
+
+func (s *failingUsageStore) IncrementUsage(batchID string, increments []*UsageIncrement) error {
+	return s.Err
+}
+
+func newTestUsageStore(t *testing.T) (*MemoryStore, []UsageEvent) {
+	t.Helper()
+
+	store := NewMemoryStore()
+
+	if err := store.InsertToken(Token{ID: "token", Application: "application", Name: "Test Token", CreatedAt: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+
+	return store, []UsageEvent{
+		{Token: "token", Timestamp: time.Now().UnixMilli(), Count: 5},
+		{Token: "token", Timestamp: time.Now().UnixMilli(), Count: 3},
+		{Token: "unknown", Timestamp: time.Now().UnixMilli(), Count: 1},
+	}
+}
+
+func TestIngestUsageBatch(t *testing.T) {
+	store, events := newTestUsageStore(t)
+
+	result, err := IngestUsageBatch(store, "batch", events)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Accepted != 2 || result.Rejected != 1 || result.Duplicate {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	if result, err = IngestUsageBatch(store, "batch", events); err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Duplicate {
+		t.Fatalf("expected the retried batch to be a duplicate, got %+v", result)
+	}
+
+	token, err := store.GetTokenByID("token")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.RequestCount != 8 {
+		t.Fatalf("expected the batch to be counted once, got %d requests", token.RequestCount)
+	}
+}
+
+func TestIngestUsageBatchFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		released bool
+	}{
+		{"failed", errors.New("write failed"), true},
+		{"incomplete", fmt.Errorf("%w: write failed", ErrUsageBatchIncomplete), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memoryStore, events := newTestUsageStore(t)
+			store := &failingUsageStore{MemoryStore: memoryStore, Err: test.err}
+
+			if _, err := IngestUsageBatch(store, "batch", events); !errors.Is(err, test.err) {
+				t.Fatalf("expected the store error, got %v", err)
+			}
+
+			claimed, err := store.InsertUsageBatch("batch")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if claimed != test.released {
+				t.Fatalf("expected claiming the batch again to return %v, got %v", test.released, claimed)
+			}
+		})
+	}
+}
+
+func TestIngestUsageBatchExpiredLease(t *testing.T) {
+	store, events := newTestUsageStore(t)
+
+	if claimed, err := store.InsertUsageBatch("pending"); err != nil || !claimed {
+		t.Fatalf("expected the batch to be claimed, got %v, %v", claimed, err)
+	}
+
+	if result, err := IngestUsageBatch(store, "pending", events); err != nil || !result.Duplicate {
+		t.Fatalf("expected a batch that is still being applied to be a duplicate, got %+v, %v", result, err)
+	}
+
+	lease := UsageBatchLease
+	UsageBatchLease = 0
+
+	defer func() {
+		UsageBatchLease = lease
+	}()
+
+	// The claim is never followed by the writes, as if the server stopped while applying the batch.
+	if claimed, err := store.InsertUsageBatch("batch"); err != nil || !claimed {
+		t.Fatalf("expected the batch to be claimed, got %v, %v", claimed, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		result, err := IngestUsageBatch(store, "batch", events)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Duplicate != (i > 0) {
+			t.Fatalf("expected only the applied batch to be a duplicate, got %+v on attempt %d", result, i+1)
+		}
+	}
+
+	token, err := store.GetTokenByID("token")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.RequestCount != 8 {
+		t.Fatalf("expected the batch to be counted once, got %d requests", token.RequestCount)
+	}
+}
+
+func TestGetApplicationUsageIntervals(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	session := signup(t, app, "owner@example.com")
+	application := createApplication(t, app, session)
+
+	tests := []struct {
+		interval string
+		status   int
+	}{
+		{"minute", http.StatusBadRequest},
+		{"hour", http.StatusOK},
+		{"day", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.interval, func(t *testing.T) {
+			if status, data := doRequest(t, app, http.MethodGet, "/applications/"+application.ID+"/usage?interval="+test.interval, session.ID, nil); status != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, status, data)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
@@ -35,9 +36,16 @@ func RandomHexString(byteLength int) string {
 	return hex.EncodeToString(data)
 }
 
-// HashPassword returns an SHA256 encoded string using the input.
-func HashPassword(password string) string {
-	hash := sha256.Sum256([]byte(password))
+// GenerateAPIToken generates a new API token in the format mcs_<prefix>_<secret>, returning the token and its prefix.
+func GenerateAPIToken() (string, string) {
+	prefix := RandomHexString(4)
+
+	return fmt.Sprintf("mcs_%s_%s", prefix, RandomHexString(24)), prefix
+}
+
+// HashAPIToken returns the SHA-256 hex digest of the API token, which is what gets stored in the database.
+func HashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
 
 	return hex.EncodeToString(hash[:])
 }
@@ -49,3 +57,14 @@ func GetSortDirectionValue(value string) int {
 
 	return -1
 }
+
+// ContainsString returns whether the value is in the list.
+func ContainsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
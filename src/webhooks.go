@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// WebhookEvents is the list of events that webhooks can subscribe to.
+	WebhookEvents []string = []string{
+		"application.created",
+		"application.updated",
+		"application.deleted",
+		"application.restored",
+		"token.created",
+		"token.updated",
+		"token.deleted",
+		"token.restored",
+		"token.rotated",
+	}
+)
+
+// Webhook is an endpoint registered by the owner of an application to receive events.
+type Webhook struct {
+	ID          string    `bson:"_id" json:"id"`
+	Application string    `bson:"application" json:"application"`
+	URL         string    `bson:"url" json:"url"`
+	Secret      string    `bson:"secret" json:"-"`
+	Events      []string  `bson:"events" json:"events"`
+	CreatedAt   time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// WebhookDelivery is a single event queued for delivery to a webhook, along with the outcome of the attempts.
+type WebhookDelivery struct {
+	ID             string     `bson:"_id" json:"id"`
+	Webhook        string     `bson:"webhook" json:"webhook"`
+	Application    string     `bson:"application" json:"application"`
+	Event          string     `bson:"event" json:"event"`
+	URL            string     `bson:"url" json:"url"`
+	Payload        string     `bson:"payload" json:"payload"`
+	Status         string     `bson:"status" json:"status"`
+	Attempts       int        `bson:"attempts" json:"attempts"`
+	NextAttemptAt  time.Time  `bson:"nextAttemptAt" json:"nextAttemptAt"`
+	LockedUntil    *time.Time `bson:"lockedUntil" json:"-"`
+	LastError      string     `bson:"lastError" json:"lastError"`
+	ResponseStatus int        `bson:"responseStatus" json:"responseStatus"`
+	CreatedAt      time.Time  `bson:"createdAt" json:"createdAt"`
+	DeliveredAt    *time.Time `bson:"deliveredAt" json:"deliveredAt"`
+}
+
+// WebhookEventPayload is the body sent to webhooks.
+type WebhookEventPayload struct {
+	ID          string      `json:"id"`
+	Event       string      `json:"event"`
+	Application string      `json:"application"`
+	Data        interface{} `json:"data"`
+	CreatedAt   time.Time   `json:"createdAt"`
+}
+
+// EmitWebhookEvent queues the event for delivery to every webhook of the application that subscribes to it.
+// Failures are logged instead of returned so that they do not affect the request that caused the event.
+func EmitWebhookEvent(store Store, application, event string, data interface{}) {
+	if err := emitWebhookEvent(store, application, event, data); err != nil {
+		log.Printf("Error: failed to queue %s webhook event for application %s: %v\n", event, application, err)
+	}
+}
+
+func emitWebhookEvent(store Store, application, event string, data interface{}) error {
+	webhooks, err := store.GetWebhooksByApplication(application)
+
+	if err != nil {
+		return err
+	}
+
+	var (
+		now      = time.Now().UTC()
+		payload  []byte
+		queue    = make([]WebhookDelivery, 0)
+		metadata = WebhookEventPayload{
+			ID:          RandomHexString(12),
+			Event:       event,
+			Application: application,
+			Data:        data,
+			CreatedAt:   now,
+		}
+	)
+
+	for _, webhook := range webhooks {
+		if !webhook.Subscribes(event) {
+			continue
+		}
+
+		if payload == nil {
+			if payload, err = json.Marshal(metadata); err != nil {
+				return err
+			}
+		}
+
+		queue = append(queue, WebhookDelivery{
+			ID:            RandomHexString(12),
+			Webhook:       webhook.ID,
+			Application:   application,
+			Event:         event,
+			URL:           webhook.URL,
+			Payload:       string(payload),
+			Status:        "pending",
+			Attempts:      0,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+	}
+
+	return store.InsertWebhookDeliveries(queue)
+}
+
+// IsWebhookEvent returns whether the event is one that webhooks can subscribe to.
+func IsWebhookEvent(event string) bool {
+	return ContainsString(WebhookEvents, event)
+}
+
+// Subscribes returns whether the webhook should receive the event.
+func (w *Webhook) Subscribes(event string) bool {
+	return ContainsString(w.Events, event)
+}
+
+// NewWebhookClient returns an HTTP client for delivering webhooks to URLs chosen by users. It only connects
+// to public addresses, checked after the host is resolved so that DNS cannot point it elsewhere, and does not
+// follow redirects.
+func NewWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: time.Second * 30,
+		Control:   checkWebhookDestination,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       time.Second * 90,
+			TLSHandshakeTimeout:   time.Second * 10,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// ValidateWebhookURL returns an error if the URL cannot be used for a webhook, which is safe to return to
+// the user. Hosts are only rejected here if they are obviously not public, since names are checked again
+// when they are resolved during delivery.
+func ValidateWebhookURL(value string) error {
+	parsed, err := url.Parse(value)
+
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Hostname()) < 1 {
+		return errors.New("webhook URL must be an HTTP or HTTPS URL")
+	}
+
+	if config.Webhooks.AllowPrivateNetworks {
+		return nil
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("webhook URL must point to a public address")
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil && !isPublicAddr(addr) {
+		return errors.New("webhook URL must point to a public address")
+	}
+
+	return nil
+}
+
+func checkWebhookDestination(network, address string, conn syscall.RawConn) error {
+	if config.Webhooks.AllowPrivateNetworks {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	addr, err := netip.ParseAddr(host)
+
+	if err != nil {
+		return err
+	}
+
+	if !isPublicAddr(addr) {
+		return fmt.Errorf("webhook destination %s is not a public address", addr)
+	}
+
+	return nil
+}
+
+// sharedAddressSpace is the range used for carrier-grade NAT, which is not routable on the internet.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// WebhookDispatcher delivers queued webhook events, retrying failed deliveries with exponential backoff.
+type WebhookDispatcher struct {
+	Store  Store
+	Client *http.Client
+}
+
+// Start runs the dispatcher in the background, polling the queue at the configured interval.
+func (d *WebhookDispatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(config.Webhooks.PollInterval)
+
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := d.DispatchDue(); err != nil {
+				log.Printf("Error: failed to dispatch webhook deliveries: %v\n", err)
+			}
+		}
+	}()
+}
+
+// DispatchDue attempts every delivery in the queue that is due, using up to the configured number of
+// deliveries at once. It returns the first error that stopped one of them.
+func (d *WebhookDispatcher) DispatchDue() error {
+	var (
+		workers = config.Webhooks.Concurrency
+		group   sync.WaitGroup
+		mutex   sync.Mutex
+		result  error
+	)
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		group.Add(1)
+
+		go func() {
+			defer group.Done()
+
+			if err := d.dispatchQueue(); err != nil {
+				mutex.Lock()
+
+				defer mutex.Unlock()
+
+				if result == nil {
+					result = err
+				}
+			}
+		}()
+	}
+
+	group.Wait()
+
+	return result
+}
+
+// dispatchQueue claims and attempts deliveries until there are none left that are due.
+func (d *WebhookDispatcher) dispatchQueue() error {
+	for {
+		now := time.Now().UTC()
+
+		delivery, err := d.Store.ClaimWebhookDelivery(now, now.Add(config.Webhooks.Timeout*2))
+
+		if err != nil {
+			return err
+		}
+
+		if delivery == nil {
+			return nil
+		}
+
+		if err := d.dispatch(delivery); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *WebhookDispatcher) dispatch(delivery *WebhookDelivery) error {
+	webhook, err := d.Store.GetWebhookByID(delivery.Webhook)
+
+	if err != nil {
+		return err
+	}
+
+	if webhook == nil {
+		return d.Store.UpdateWebhookDeliveryByID(delivery.ID, Fields{
+			"status":      "failed",
+			"lastError":   "The webhook was deleted",
+			"lockedUntil": nil,
+		})
+	}
+
+	statusCode, deliveryErr := d.send(webhook, delivery)
+
+	now := time.Now().UTC()
+	attempts := delivery.Attempts + 1
+
+	if deliveryErr == nil {
+		return d.Store.UpdateWebhookDeliveryByID(delivery.ID, Fields{
+			"status":         "delivered",
+			"attempts":       attempts,
+			"lastError":      "",
+			"responseStatus": statusCode,
+			"deliveredAt":    now,
+			"lockedUntil":    nil,
+		})
+	}
+
+	update := Fields{
+		"attempts":       attempts,
+		"lastError":      deliveryErr.Error(),
+		"responseStatus": statusCode,
+		"lockedUntil":    nil,
+	}
+
+	if attempts >= config.Webhooks.MaxAttempts {
+		update["status"] = "failed"
+	} else {
+		update["nextAttemptAt"] = now.Add(GetWebhookBackoff(attempts))
+	}
+
+	return d.Store.UpdateWebhookDeliveryByID(delivery.ID, update)
+}
+
+func (d *WebhookDispatcher) send(webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Mcstatus-Event", delivery.Event)
+	req.Header.Set("X-Mcstatus-Delivery", delivery.ID)
+	req.Header.Set("X-Mcstatus-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Mcstatus-Signature", fmt.Sprintf("v1=%s", SignWebhookPayload(webhook.Secret, timestamp, body)))
+
+	resp, err := d.Client.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// GetWebhookBackoff returns how long to wait before the next attempt after the given number of failed attempts.
+func GetWebhookBackoff(attempts int) time.Duration {
+	backoff := config.Webhooks.InitialBackoff
+
+	for i := 1; i < attempts && backoff < config.Webhooks.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > config.Webhooks.MaxBackoff {
+		return config.Webhooks.MaxBackoff
+	}
+
+	return backoff
+}
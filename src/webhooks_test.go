@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://example.com/webhook", true},
+		{"http://93.184.216.34/webhook", true},
+		{"ftp://example.com/webhook", false},
+		{"http://localhost:8080/webhook", false},
+		{"http://api.localhost/webhook", false},
+		{"http://127.0.0.1/webhook", false},
+		{"http://10.0.0.1/webhook", false},
+		{"http://192.168.1.1/webhook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://100.64.0.1/webhook", false},
+		{"http://0.0.0.0/webhook", false},
+		{"http://[::1]/webhook", false},
+		{"http://[fd00::1]/webhook", false},
+		{"http://[::ffff:127.0.0.1]/webhook", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			if err := ValidateWebhookURL(test.url); (err == nil) != test.valid {
+				t.Fatalf("expected valid to be %v, got error %v", test.valid, err)
+			}
+		})
+	}
+}
+
+func TestWebhookClientRejectsPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer server.Close()
+
+	if _, err := NewWebhookClient(time.Second).Post(server.URL, "application/json", nil); err == nil {
+		t.Fatal("expected the request to a loopback address to be rejected")
+	}
+}
+
+func TestWebhookClientDoesNotFollowRedirects(t *testing.T) {
+	config.Webhooks.AllowPrivateNetworks = true
+
+	defer func() {
+		config.Webhooks.AllowPrivateNetworks = false
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/", http.StatusFound)
+	}))
+
+	defer server.Close()
+
+	resp, err := NewWebhookClient(time.Second).Post(server.URL, "application/json", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected the redirect to be returned, got %d", resp.StatusCode)
+	}
+}
+
+func TestWebhookDispatcherDispatchDue(t *testing.T) {
+	config.Webhooks.AllowPrivateNetworks = true
+
+	defer func() {
+		config.Webhooks.AllowPrivateNetworks = false
+	}()
+
+	var received int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&received, 1)
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer server.Close()
+
+	store := NewMemoryStore()
+	now := time.Now().UTC()
+
+	if err := store.InsertWebhook(Webhook{ID: "webhook", Application: "application", URL: server.URL, Secret: "secret", Events: WebhookEvents, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := make([]WebhookDelivery, 0, 20)
+
+	for i := 0; i < cap(deliveries); i++ {
+		deliveries = append(deliveries, WebhookDelivery{
+			ID:            fmt.Sprintf("delivery-%d", i),
+			Webhook:       "webhook",
+			Application:   "application",
+			Event:         "token.created",
+			URL:           server.URL,
+			Payload:       "{}",
+			Status:        "pending",
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+	}
+
+	if err := store.InsertWebhookDeliveries(deliveries); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatcher := &WebhookDispatcher{Store: store, Client: NewWebhookClient(time.Second)}
+
+	if err := dispatcher.DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+
+	if received != int64(len(deliveries)) {
+		t.Fatalf("expected each of the %d deliveries to be sent once, got %d requests", len(deliveries), received)
+	}
+
+	results, err := store.GetWebhookDeliveriesByWebhook("webhook", int64(len(deliveries)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, delivery := range results {
+		if delivery.Status != "delivered" {
+			t.Fatalf("expected delivery %s to be delivered, got %s: %s", delivery.ID, delivery.Status, delivery.LastError)
+		}
+	}
+}